@@ -2,13 +2,21 @@ package main
 
 import (
 	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/events"
 	"42ActivityAPI/internal/handlers"
 	"42ActivityAPI/internal/loadconfig"
+	"42ActivityAPI/internal/mqttingest"
+	"context"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -19,14 +27,80 @@ func main() {
 		return
 	}
 
+	// Receive taps over MQTT as well if a broker is configured
+	var subscriber *mqttingest.Subscriber
+	if broker := os.Getenv("MQTT_BROKER"); broker != "" {
+		subscriber, err = startMQTTIngestion(broker)
+		if err != nil {
+			log.Println("Failed to start MQTT ingestion: ", err)
+			return
+		}
+	}
+
+	// Refresh the cached leaderboards, watch the M5sticks, send shift reminders, escalate missed shifts, and relay the events in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var workers sync.WaitGroup
+	runWorker(&workers, func() {
+		handlers.RunLeaderboardRefresher(ctx, time.Duration(loadconfig.GetEnvInt("LEADERBOARD_REFRESH_SECONDS", 300))*time.Second)
+	})
+	runWorker(&workers, func() {
+		handlers.RunDeviceMonitor(ctx, time.Duration(loadconfig.GetEnvInt("M5STICK_MONITOR_SECONDS", 60))*time.Second)
+	})
+	runWorker(&workers, func() {
+		handlers.RunReminderScheduler(ctx, time.Duration(loadconfig.GetEnvInt("REMINDER_CHECK_SECONDS", 60))*time.Second)
+	})
+	runWorker(&workers, func() {
+		handlers.RunMissedShiftEscalator(ctx, time.Duration(loadconfig.GetEnvInt("MISSED_SHIFT_CHECK_SECONDS", 3600))*time.Second)
+	})
+	runWorker(&workers, func() {
+		handlers.RunEventRelay(ctx, time.Duration(loadconfig.GetEnvInt("OUTBOX_POLL_SECONDS", 5))*time.Second, time.Duration(loadconfig.GetEnvInt("WEBHOOK_POLL_SECONDS", 5))*time.Second)
+	})
+
 	router := gin.Default()
 	router.LoadHTMLGlob("web/templates/*")
 
+	// Only the proxies in TRUSTED_PROXIES may tell the client address, so that it cannot be forged
+	if err := router.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Println("Failed to set trusted proxies: ", err)
+		return
+	}
+
 	// CORS Settings
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"}
+	config.AddExposeHeaders("X-Request-ID")
 	router.Use(cors.New(config))
 
+	// Give every request an ID and write the mutating ones to the audit log
+	router.Use(handlers.AuditRequests())
+
+	registerRoutes(router)
+
+	server := newServer(router)
+	// Streams would hold the shutdown until the timeout, so they are ended for their clients to reconnect elsewhere
+	server.RegisterOnShutdown(events.Default.CloseSubscriptions)
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("Listening on", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Wait for docker compose down or Ctrl-C
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-signals.Done():
+		log.Println("Shutting down")
+	case err := <-serverErr:
+		log.Println("Failed to serve: ", err)
+	}
+	stop()
+	shutdown(server, subscriber, cancel, &workers, time.Duration(loadconfig.GetEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 20))*time.Second)
+}
+
+// Registers the endpoints of the API on the router.
+func registerRoutes(router *gin.Engine) {
 	router.GET("/", ShowIndexPage)
 	router.GET("/new", RedirectToIndexWithUID)
 	router.GET("/callback", ShowCallbackPage)
@@ -36,21 +110,171 @@ func main() {
 	router.GET("/shifts", handlers.GetShiftData)
 	router.POST("/shifts", handlers.AddShiftData)
 	router.POST("/shifts/exchange", handlers.ExchangeShiftData)
-	router.DELETE("/shifts", handlers.DeleteShiftData)
+	router.DELETE("/shifts", handlers.RequireStaff(), handlers.DeleteShiftData)
+	router.DELETE("/shifts/range", handlers.RequireStaff(), handlers.DeleteShiftRangeData)
+	router.GET("/shifts/deleted", handlers.RequireStaff(), handlers.GetDeletedShiftData)
+	router.GET("/shifts/missed", handlers.RequireStaff(), handlers.GetMissedShifts)
+	router.POST("/shifts/missed/check", handlers.RequireStaff(), handlers.CheckMissedShifts)
+	router.POST("/shifts/missed/:id/resolve", handlers.RequireStaff(), handlers.ResolveMissedShift)
+	router.POST("/shifts/:id/restore", handlers.RequireStaff(), handlers.RestoreShiftData)
+	router.GET("/shifts/slots", handlers.GetSlotData)
+	router.POST("/shifts/slots", handlers.RequireStaff(), handlers.AddSlotData)
+	router.POST("/shifts/slots/:id/claim", handlers.ClaimSlot)
+	router.DELETE("/shifts/slots/:id/claim", handlers.ReleaseSlot)
+
+	router.GET("/calendar/token", handlers.GetCalendarURL)
+	router.POST("/calendar/token", handlers.ResetCalendarURL)
+	router.GET("/calendar/users/:token", handlers.GetUserCalendar)
+	router.GET("/calendar/campus/:token", handlers.GetCampusCalendar)
 
 	router.POST("/activities", handlers.AddActivity)
 	router.GET("/activities/cleanings", handlers.GetActivityCleanData)
+	router.GET("/activities/pending", handlers.RequireStaff(), handlers.GetPendingTapData)
+	router.GET("/activities/stream", handlers.StreamActivities)
+
+	router.GET("/stats/activities", handlers.GetActivityStats)
+	router.GET("/leaderboards", handlers.GetLeaderboard)
+
+	router.GET("/dashboard/ws", handlers.DashboardWebSocket)
+
+	router.GET("/webhooks", handlers.RequireStaff(), handlers.GetWebhooks)
+	router.POST("/webhooks", handlers.RequireStaff(), handlers.AddWebhook)
+	router.DELETE("/webhooks/:id", handlers.RequireStaff(), handlers.DeleteWebhook)
+	router.GET("/webhooks/:id/deliveries", handlers.RequireStaff(), handlers.GetWebhookDeliveries)
+	router.POST("/webhooks/deliveries/:id/redeliver", handlers.RequireStaff(), handlers.RedeliverWebhookDelivery)
 
 	router.POST("/roles", handlers.AddRole)
+	router.PUT("/roles/:name/firmware", handlers.RequireStaff(), handlers.SetRoleFirmware)
 
 	router.POST("/locations", handlers.AddLocation)
 
 	router.POST("/m5sticks", handlers.AddM5Stick)
+	router.GET("/m5sticks/health", handlers.RequireStaff(), handlers.GetM5StickHealth)
+	router.POST("/m5sticks/enrollment-codes", handlers.RequireStaff(), handlers.AddEnrollmentCode)
+	router.POST("/m5sticks/enroll", handlers.EnrollM5Stick)
+	router.POST("/m5sticks/:mac/heartbeat", handlers.RecordHeartbeat)
+	router.GET("/m5sticks/:mac/config", handlers.GetM5StickConfig)
+	router.PUT("/m5sticks/:mac/config", handlers.RequireStaff(), handlers.UpdateM5StickConfig)
+	router.PUT("/m5sticks/:mac/firmware", handlers.RequireStaff(), handlers.SetM5StickFirmware)
+	router.GET("/m5sticks/:mac/update", handlers.CheckFirmwareUpdate)
+
+	router.GET("/firmwares", handlers.GetFirmwares)
+	router.POST("/firmwares", handlers.RequireStaff(), handlers.AddFirmware)
+	router.GET("/firmwares/:id/download", handlers.DownloadFirmware)
 
 	router.POST("/users", handlers.AddUsers)
 	router.PUT("/users", handlers.EditUser)
+	router.POST("/users/wallet/challenge", handlers.AddWalletChallenge)
+	router.POST("/users/wallet/verify", handlers.VerifyWallet)
+	router.PUT("/users/leaderboard", handlers.SetLeaderboardOptOut)
+
+	router.GET("/points/rules", handlers.GetPointRules)
+	router.PUT("/points/rules", handlers.RequireStaff(), handlers.SetPointRule)
+	router.POST("/points/accrue", handlers.RequireStaff(), handlers.AccruePoints)
+	router.GET("/points/balances", handlers.GetBalances)
+	router.GET("/points/users/:login", handlers.GetUserPoints)
+	router.POST("/points/adjustments", handlers.RequireStaff(), handlers.AddPointAdjustment)
+
+	router.GET("/payouts", handlers.RequireStaff(), handlers.GetPayoutBatches)
+	router.POST("/payouts", handlers.RequireStaff(), handlers.AddPayoutBatch)
+	router.GET("/payouts/:id", handlers.RequireStaff(), handlers.GetPayoutBatch)
+	router.DELETE("/payouts/:id", handlers.RequireStaff(), handlers.DeletePayoutBatch)
+	router.POST("/payouts/:id/recalculate", handlers.RequireStaff(), handlers.RecalculatePayoutBatch)
+	router.POST("/payouts/:id/approve", handlers.RequireStaff(), handlers.ApprovePayoutBatch)
+	router.POST("/payouts/:id/paid", handlers.RequireStaff(), handlers.MarkPayoutBatchPaid)
+	router.GET("/payouts/:id/export", handlers.RequireStaff(), handlers.ExportPayoutBatch)
 
-	router.Run(":" + os.Getenv("PORT"))
+	router.GET("/audit", handlers.RequireStaff(), handlers.GetAuditLogs)
+}
+
+// Runs the worker in the background, counting it in the wait group until it returns.
+func runWorker(workers *sync.WaitGroup, worker func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		worker()
+	}()
+}
+
+/*
+Returns the addresses or CIDRs in TRUSTED_PROXIES, separated by commas.
+While it is not set, no proxy is trusted and the client address is the address of the connection.
+*/
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// Returns the server of the router at PORT, with the timeouts from the environment.
+func newServer(router http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + os.Getenv("PORT"),
+		Handler:           router,
+		ReadHeaderTimeout: time.Duration(loadconfig.GetEnvInt("HTTP_READ_HEADER_TIMEOUT_SECONDS", 10)) * time.Second,
+		ReadTimeout:       time.Duration(loadconfig.GetEnvInt("HTTP_READ_TIMEOUT_SECONDS", 60)) * time.Second,
+		WriteTimeout:      time.Duration(loadconfig.GetEnvInt("HTTP_WRITE_TIMEOUT_SECONDS", 60)) * time.Second,
+		IdleTimeout:       time.Duration(loadconfig.GetEnvInt("HTTP_IDLE_TIMEOUT_SECONDS", 120)) * time.Second,
+	}
+}
+
+/*
+Stops taking requests and waits for the ones in progress, stops receiving taps over MQTT,
+then stops the background workers and waits for them, and closes the DB last, as all of them use it.
+Waiting is bounded by the timeout as a whole.
+*/
+func shutdown(server *http.Server, subscriber *mqttingest.Subscriber, stopWorkers context.CancelFunc, workers *sync.WaitGroup, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Failed to finish the requests in progress: ", err)
+	}
+	if subscriber != nil {
+		subscriber.Close()
+	}
+
+	stopWorkers()
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Println("Background workers did not stop in time")
+	}
+
+	if err := accessdb.CloseDB(); err != nil {
+		log.Println("Failed to close the database: ", err)
+	}
+	log.Println("Shut down")
+}
+
+// Subscribe to the taps of the M5sticks on the broker, and record them the same way as POST /activities.
+func startMQTTIngestion(broker string) (*mqttingest.Subscriber, error) {
+	config := mqttingest.Config{
+		Broker:      broker,
+		ClientID:    loadconfig.GetEnv("MQTT_CLIENT_ID", "ft_activity_api"),
+		Username:    os.Getenv("MQTT_USERNAME"),
+		Password:    os.Getenv("MQTT_PASSWORD"),
+		TopicPrefix: loadconfig.GetEnv("MQTT_TOPIC_PREFIX", "m5sticks"),
+	}
+	return mqttingest.Start(config, recordMQTTTap)
+}
+
+// Record a tap received over MQTT once the token of the M5stick is checked, as POST /activities does.
+func recordMQTTTap(mac string, uid string, token string) (int, error) {
+	if status, err := accessdb.VerifyM5StickToken(mac, token); err != nil {
+		return status, err
+	}
+	status, _, err := accessdb.AddActivityToDB(uid, mac)
+	return status, err
 }
 
 func ShowIndexPage(c *gin.Context) {
@@ -2,16 +2,47 @@ package main
 
 import (
 	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/escalation"
+	"42ActivityAPI/internal/events"
 	"42ActivityAPI/internal/handlers"
+	"42ActivityAPI/internal/icalendar"
+	"42ActivityAPI/internal/leaderboard"
 	"42ActivityAPI/internal/loadconfig"
+	"42ActivityAPI/internal/mqttingest"
+	"42ActivityAPI/internal/notify"
+	"42ActivityAPI/internal/outbox"
+	"42ActivityAPI/internal/reminder"
+	"42ActivityAPI/internal/wallet"
+	"42ActivityAPI/internal/webhook"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/sha3"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"io"
+	"mime/multipart"
 	_ "modernc.org/sqlite"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -23,7 +54,7 @@ func setupTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	db.AutoMigrate(&accessdb.Shift{}, &accessdb.User{}, &accessdb.M5Stick{}, &accessdb.Activity{}, &accessdb.Location{}, &accessdb.Role{})
+	db.AutoMigrate(&accessdb.Shift{}, &accessdb.Slot{}, &accessdb.User{}, &accessdb.WalletChallenge{}, &accessdb.M5Stick{}, &accessdb.EnrollmentCode{}, &accessdb.Firmware{}, &accessdb.Activity{}, &accessdb.PendingTap{}, &accessdb.Location{}, &accessdb.Role{}, &accessdb.PointRule{}, &accessdb.PointEntry{}, &accessdb.PayoutBatch{}, &accessdb.PayoutItem{}, &accessdb.OutboxEvent{}, &accessdb.Webhook{}, &accessdb.WebhookDelivery{}, &accessdb.ReminderLog{}, &accessdb.EscalationLog{}, &accessdb.MissedShift{}, &accessdb.AuditLog{})
 	return db
 }
 
@@ -44,6 +75,1783 @@ func TestGetQueryAboutTime(t *testing.T) {
 	assert.Equal(t, int64(200), end)
 }
 
+func TestSlotStartsAt(t *testing.T) {
+	slot := accessdb.Slot{Date: "2024-06-01", StartTime: "10:30"}
+	startsAt, err := slot.StartsAt()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 6, 1, 10, 30, 0, 0, time.Local), startsAt)
+
+	slot = accessdb.Slot{Date: "2024-06-01"}
+	startsAt, err = slot.StartsAt()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local), startsAt)
+}
+
+func TestFindMissedShifts(t *testing.T) {
+	cleaning, other := 1, 2
+	at := func(date string) int64 {
+		d, _ := time.ParseInLocation("2006-01-02 15:04", date+" 12:00", time.Local)
+		return d.Unix()
+	}
+	shifts := []accessdb.Shift{
+		{ID: 1, Date: "2024-06-01", UserID: 1},
+		{ID: 2, Date: "2024-06-01", UserID: 2, Slot: &accessdb.Slot{RoleId: &cleaning}},
+		{ID: 3, Date: "2024-06-02", UserID: 1},
+	}
+	activities := []accessdb.Activity{
+		{ID: 1, UserID: 1, M5Stick: accessdb.M5Stick{RoleId: other}, CreatedAt: at("2024-06-01")},
+		{ID: 2, UserID: 2, M5Stick: accessdb.M5Stick{RoleId: other}, CreatedAt: at("2024-06-01")},
+	}
+	missed := accessdb.FindMissedShifts(shifts, activities)
+
+	assert.Len(t, missed, 2)
+	assert.Equal(t, uint(2), missed[0].ID)
+	assert.Equal(t, uint(3), missed[1].ID)
+
+	m := accessdb.MissedShift{User: accessdb.User{Login: "user1"}, Date: "2024-06-02", Misses: 3, Penalty: 10}
+	assert.Contains(t, escalation.StudentMessage(m).Body, "10 points were deducted")
+	assert.Equal(t, "staff1", escalation.StaffMessage(m, "staff1").Login)
+}
+
+// A notifier that records the logins it notified, and fails while fail is set.
+type testNotifier struct {
+	name     string
+	fail     bool
+	notified []string
+}
+
+func (n *testNotifier) Name() string {
+	return n.name
+}
+
+func (n *testNotifier) Notify(ctx context.Context, message notify.Message) error {
+	if n.fail {
+		return errors.New("Unavailable")
+	}
+	n.notified = append(n.notified, message.Login)
+	return nil
+}
+
+func TestSMTPNotifierStopsWithContext(t *testing.T) {
+	// A server that accepts the connection but never greets.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			<-done
+			conn.Close()
+		}
+	}()
+
+	n := notify.SMTPNotifier{Addr: listener.Addr().String(), From: "noreply@example.com", Domain: "example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	assert.Error(t, n.Notify(ctx, notify.Message{Login: "user1", Subject: "Shift", Body: "Tomorrow"}))
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
+
+func TestEscalatorSendsEachChannelOnce(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.User{Login: "user1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.MissedShift{ShiftID: 1, UserID: 1, Date: "2024-06-02", Misses: 3, Escalated: true, DetectedAt: 1}).Error)
+
+	mail := &testNotifier{name: "mail"}
+	slack := &testNotifier{name: "slack", fail: true}
+	escalator := escalation.NewEscalator([]notify.Notifier{mail, slack}, []string{"staff1"}, accessdb.MissRule{StaffThreshold: 3, PeriodDays: 30}, 7)
+	now := time.Date(2024, 6, 3, 9, 0, 0, 0, time.Local)
+	escalator.Check(context.Background(), now)
+	assert.Equal(t, []string{"user1", "staff1"}, mail.notified)
+
+	// Only the channel that failed is sent the notifications again.
+	slack.fail = false
+	escalator.Check(context.Background(), now)
+	assert.Equal(t, []string{"user1", "staff1"}, mail.notified)
+	assert.Equal(t, []string{"user1", "staff1"}, slack.notified)
+	var missed accessdb.MissedShift
+	assert.NoError(t, db.First(&missed).Error)
+	assert.NotZero(t, missed.StudentNotifiedAt)
+	assert.NotZero(t, missed.StaffNotifiedAt)
+	var logs int64
+	assert.NoError(t, db.Model(&accessdb.EscalationLog{}).Count(&logs).Error)
+	assert.Equal(t, int64(4), logs)
+
+	escalator.Check(context.Background(), now)
+	assert.Len(t, slack.notified, 2)
+}
+
+func TestDueReminders(t *testing.T) {
+	offsets, err := reminder.ParseOffsets("1h, 24h")
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{24 * time.Hour, time.Hour}, offsets)
+
+	now := time.Date(2024, 6, 1, 9, 30, 0, 0, time.Local)
+	shifts := []accessdb.Shift{
+		{ID: 1, Date: "2024-06-01", Slot: &accessdb.Slot{Date: "2024-06-01", StartTime: "10:00"}},
+		{ID: 2, Date: "2024-06-02", Slot: &accessdb.Slot{Date: "2024-06-02", StartTime: "09:15"}},
+		{ID: 3, Date: "2024-06-02"},
+		{ID: 4, Date: "2024-06-03"},
+		{ID: 5, Date: "2024-06-01", Slot: &accessdb.Slot{Date: "2024-06-01", StartTime: "09:00"}},
+	}
+	reminders := reminder.Due(shifts, offsets, now, "09:00")
+
+	assert.Len(t, reminders, 3)
+	assert.Equal(t, uint(1), reminders[0].Shift.ID)
+	assert.Equal(t, time.Hour, reminders[0].Offset)
+	assert.Equal(t, uint(2), reminders[1].Shift.ID)
+	assert.Equal(t, 24*time.Hour, reminders[1].Offset)
+	assert.Equal(t, uint(3), reminders[2].Shift.ID)
+	assert.Equal(t, "You have a shift on 2024-06-01 10:00.", reminders[0].Message().Body)
+}
+
+func TestPairSessions(t *testing.T) {
+	at := func(hour int) int64 { return time.Date(2024, 6, 1, hour, 0, 0, 0, time.Local).Unix() }
+	cleaning := accessdb.M5Stick{RoleId: 1}
+	guide := accessdb.M5Stick{RoleId: 2}
+	activities := []accessdb.Activity{
+		{ID: 3, UserID: 1, M5Stick: cleaning, CreatedAt: at(12)},
+		{ID: 1, UserID: 1, M5Stick: cleaning, CreatedAt: at(10)},
+		{ID: 2, UserID: 1, M5Stick: guide, CreatedAt: at(11)},
+		{ID: 4, UserID: 2, M5Stick: cleaning, CreatedAt: at(13)},
+	}
+	sessions := accessdb.PairSessions(activities)
+
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, uint(1), sessions[0].Open.ID)
+	assert.Equal(t, uint(3), sessions[0].Close.ID)
+	assert.Equal(t, int64(2*3600), sessions[0].Duration())
+}
+
+func TestEventBusResume(t *testing.T) {
+	bus := events.NewBus(2)
+	bus.PublishEvent(events.Event{ID: 1, Type: "activity.created", Data: 1})
+	bus.PublishEvent(events.Event{ID: 2, Type: "activity.created", Data: 2})
+	bus.PublishEvent(events.Event{ID: 3, Type: "activity.created", Data: 3})
+
+	subscription, missed := bus.Subscribe(1)
+	defer subscription.Close()
+	assert.Len(t, missed, 2)
+	assert.Equal(t, 2, missed[0].Data)
+	assert.Equal(t, 3, missed[1].Data)
+
+	live := events.Event{ID: 4, Type: "activity.created", Data: 4}
+	bus.PublishEvent(live)
+	assert.Equal(t, live, <-subscription.C)
+}
+
+func TestRelayPendingOutboxEvents(t *testing.T) {
+	db := useTestDB(t)
+	for _, eventType := range []string{"shift.deleted", "device.offline", "device.online"} {
+		assert.NoError(t, accessdb.AddOutboxEventToDB(eventType, map[string]string{"type": eventType}))
+	}
+
+	// The events keep the IDs of the outbox, and only the relayed ones are marked as dispatched.
+	bus := events.NewBus(10)
+	subscription, _ := bus.Subscribe(0)
+	defer subscription.Close()
+	count, err := accessdb.RelayPendingOutboxEventsOnDB(10, 1712666900, func(outboxEvents []accessdb.OutboxEvent) []uint {
+		assert.Len(t, outboxEvents, 3)
+		for _, o := range outboxEvents[:2] {
+			bus.PublishEvent(events.Event{ID: int64(o.ID), Type: o.Type})
+		}
+		return []uint{outboxEvents[0].ID, outboxEvents[1].ID}
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, events.Event{ID: 1, Type: "shift.deleted"}, <-subscription.C)
+	assert.Equal(t, events.Event{ID: 2, Type: "device.offline"}, <-subscription.C)
+
+	count, err = accessdb.RelayPendingOutboxEventsOnDB(10, 1712666901, func(outboxEvents []accessdb.OutboxEvent) []uint {
+		assert.Len(t, outboxEvents, 1)
+		assert.Equal(t, uint(3), outboxEvents[0].ID)
+		return []uint{outboxEvents[0].ID}
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	var pending int64
+	assert.NoError(t, db.Model(&accessdb.OutboxEvent{}).Where("dispatched_at = ?", 0).Count(&pending).Error)
+	assert.Equal(t, int64(0), pending)
+}
+
+func TestOutboxEventsArePublishedOnEveryInstance(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, accessdb.AddOutboxEventToDB("device.offline", map[string]string{}))
+
+	// Two instances start from the latest event, and each publishes every later event to its own bus.
+	var subscriptions []*events.Subscription
+	var relays []*outbox.Relay
+	for range 2 {
+		bus := events.NewBus(10)
+		subscription, _ := bus.Subscribe(0)
+		defer subscription.Close()
+		relay := outbox.NewRelay(bus, nil, time.Hour)
+		relay.Publish()
+		subscriptions = append(subscriptions, subscription)
+		relays = append(relays, relay)
+	}
+	assert.NoError(t, accessdb.AddOutboxEventToDB("shift.deleted", map[string]string{}))
+	// The event with ID 4 is written by a transaction that commits after the one with ID 5.
+	assert.NoError(t, db.Create(&accessdb.OutboxEvent{ID: 5, Type: "device.online", Payload: "{}"}).Error)
+	for i, relay := range relays {
+		relay.Publish()
+		assert.Equal(t, int64(2), (<-subscriptions[i].C).ID)
+		assert.Equal(t, int64(5), (<-subscriptions[i].C).ID)
+	}
+	assert.NoError(t, db.Create(&accessdb.OutboxEvent{ID: 4, Type: "device.offline", Payload: "{}"}).Error)
+	for i, relay := range relays {
+		relay.Publish()
+		assert.Equal(t, int64(4), (<-subscriptions[i].C).ID)
+		assert.Len(t, subscriptions[i].C, 0)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	router := gin.New()
+	router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+	bus := events.NewBus(1)
+	subscription, _ := bus.Subscribe(0)
+	server := newServer(router)
+	server.RegisterOnShutdown(bus.CloseSubscriptions)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(listener)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	workerStopped := false
+	runWorker(&workers, func() {
+		<-ctx.Done()
+		workerStopped = true
+	})
+
+	response := make(chan int)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			response <- 0
+			return
+		}
+		resp.Body.Close()
+		response <- resp.StatusCode
+	}()
+	<-started
+	shutdown(server, nil, cancel, &workers, 5*time.Second)
+
+	// The request in progress is finished before the workers are stopped.
+	assert.Equal(t, http.StatusOK, <-response)
+	assert.True(t, workerStopped)
+	// Streams are ended for their clients to reconnect.
+	_, ok := <-subscription.C
+	assert.False(t, ok)
+}
+
+func TestSlotCapacity(t *testing.T) {
+	tests := []struct {
+		capacity int
+		booked   int64
+		full     bool
+		fits     bool
+	}{
+		{capacity: 0, booked: 5, full: false, fits: true},
+		{capacity: 2, booked: 1, full: false, fits: true},
+		{capacity: 2, booked: 2, full: true, fits: true},
+		{capacity: 2, booked: 3, full: true, fits: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.full, accessdb.SlotIsFull(tt.capacity, tt.booked), "capacity %d, booked %d", tt.capacity, tt.booked)
+		assert.Equal(t, tt.fits, accessdb.CapacityFitsBooked(tt.capacity, tt.booked), "capacity %d, booked %d", tt.capacity, tt.booked)
+	}
+}
+
+func TestSelectShift(t *testing.T) {
+	slot1, slot2, slot3 := uint(1), uint(2), uint(3)
+	wholeDay := accessdb.Shift{ID: 1, Date: "2024-06-01", UserID: 1}
+	inSlot1 := accessdb.Shift{ID: 2, Date: "2024-06-01", UserID: 1, SlotID: &slot1}
+	inSlot2 := accessdb.Shift{ID: 3, Date: "2024-06-01", UserID: 1, SlotID: &slot2}
+	tests := []struct {
+		name   string
+		shifts []accessdb.Shift
+		slotId *uint
+		status int
+		id     uint
+	}{
+		{name: "single shift", shifts: []accessdb.Shift{wholeDay}, status: http.StatusOK, id: 1},
+		{name: "ambiguous", shifts: []accessdb.Shift{wholeDay, inSlot1, inSlot2}, status: http.StatusConflict},
+		{name: "by slot", shifts: []accessdb.Shift{wholeDay, inSlot1, inSlot2}, slotId: &slot2, status: http.StatusOK, id: 3},
+		{name: "slot not matched", shifts: []accessdb.Shift{wholeDay, inSlot1}, slotId: &slot3, status: http.StatusNotFound},
+		{name: "no shift", shifts: nil, status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		status, shift, err := accessdb.SelectShift(tt.shifts, tt.slotId)
+		assert.Equal(t, tt.status, status, tt.name)
+		if tt.status != http.StatusOK {
+			assert.Error(t, err, tt.name)
+			continue
+		}
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.id, shift.ID, tt.name)
+	}
+}
+
+// Open an empty in-memory database for the test, and make accessdb use it until the test ends.
+func useTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&accessdb.Shift{}, &accessdb.Slot{}, &accessdb.User{}, &accessdb.WalletChallenge{}, &accessdb.M5Stick{}, &accessdb.EnrollmentCode{}, &accessdb.Firmware{}, &accessdb.Activity{}, &accessdb.PendingTap{}, &accessdb.Location{}, &accessdb.Role{}, &accessdb.PointRule{}, &accessdb.PointEntry{}, &accessdb.PayoutBatch{}, &accessdb.PayoutItem{}, &accessdb.OutboxEvent{}, &accessdb.Webhook{}, &accessdb.WebhookDelivery{}, &accessdb.ReminderLog{}, &accessdb.EscalationLog{}, &accessdb.MissedShift{}, &accessdb.AuditLog{}); err != nil {
+		t.Fatal(err)
+	}
+	accessdb.UseDB(db)
+	t.Cleanup(func() {
+		accessdb.UseDB(nil)
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// Build a multipart request uploading a firmware binary.
+func newFirmwareRequest(t *testing.T, version string, channel string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("version", version)
+	if channel != "" {
+		writer.WriteField("channel", channel)
+	}
+	part, err := writer.CreateFormFile("file", "firmware.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("firmware " + version))
+	writer.Close()
+	req := httptest.NewRequest("POST", "/firmwares", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestAddFirmware(t *testing.T) {
+	db := useTestDB(t)
+	dir := t.TempDir()
+	t.Setenv("FIRMWARE_DIR", dir)
+	router := gin.New()
+	router.POST("/firmwares", handlers.AddFirmware)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newFirmwareRequest(t, "1.0.0", "nightly"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newFirmwareRequest(t, "1.0.0", "beta"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	content, err := os.ReadFile(filepath.Join(dir, "firmware-1.0.0.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "firmware 1.0.0", string(content))
+
+	// The binary of an existing version is not overwritten.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newFirmwareRequest(t, "1.0.0", ""))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	content, err = os.ReadFile(filepath.Join(dir, "firmware-1.0.0.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "firmware 1.0.0", string(content))
+
+	// A firmware whose binary cannot be moved into place is not left in the catalog.
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "firmware-1.1.0.bin", "taken"), 0755))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newFirmwareRequest(t, "1.1.0", ""))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var count int64
+	assert.NoError(t, db.Model(&accessdb.Firmware{}).Where("version = ?", "1.1.0").Count(&count).Error)
+	assert.Zero(t, count)
+}
+
+func TestCheckFirmwareUpdateChannel(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.Location{Name: "F1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.Firmware{{Version: "1.1.0", Channel: "stable"}, {Version: "1.2.0-beta", Channel: "beta"}}).Error)
+	stable, beta := uint(1), uint(2)
+	assert.NoError(t, db.Create(&[]accessdb.M5Stick{
+		{Mac: "00:00:00:00:00:01", RoleId: 1, LocationId: 1, FirmwareVersion: "1.0.0", FirmwareID: &stable},
+		{Mac: "00:00:00:00:00:02", RoleId: 1, LocationId: 1, FirmwareVersion: "1.0.0", FirmwareID: &beta},
+	}).Error)
+
+	router := gin.New()
+	router.GET("/m5sticks/:mac/update", handlers.CheckFirmwareUpdate)
+	tests := []struct {
+		mac     string
+		channel string
+		status  int
+		update  bool
+	}{
+		{mac: "00:00:00:00:00:01", channel: "", status: http.StatusOK, update: true},
+		{mac: "00:00:00:00:00:01", channel: "beta", status: http.StatusOK, update: true},
+		{mac: "00:00:00:00:00:02", channel: "", status: http.StatusOK, update: false},
+		{mac: "00:00:00:00:00:02", channel: "stable", status: http.StatusOK, update: false},
+		{mac: "00:00:00:00:00:02", channel: "beta", status: http.StatusOK, update: true},
+		{mac: "00:00:00:00:00:02", channel: "nightly", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		url := "/m5sticks/" + tt.mac + "/update"
+		if tt.channel != "" {
+			url += "?channel=" + tt.channel
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, tt.status, w.Code, tt.mac+" "+tt.channel)
+		if tt.status == http.StatusOK {
+			assert.Contains(t, w.Body.String(), fmt.Sprintf(`"update":%t`, tt.update), tt.mac+" "+tt.channel)
+		}
+	}
+}
+
+func TestAddEnrollmentCode(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.Location{Name: "F1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+
+	codes := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		code, err := accessdb.AddEnrollmentCodeToDB("Cleaning", "F1", time.Now().Unix()+60)
+		assert.NoError(t, err)
+		assert.Regexp(t, `^[A-HJ-NP-Z2-9]{10}$`, code.Code)
+		assert.Equal(t, "Cleaning", code.Role.Name)
+		assert.Equal(t, "F1", code.Location.Name)
+		codes[code.Code] = true
+	}
+	assert.Len(t, codes, 20)
+
+	_, err := accessdb.AddEnrollmentCodeToDB("Cleaning", "F9", time.Now().Unix()+60)
+	assert.Error(t, err)
+}
+
+func TestEnrollM5Stick(t *testing.T) {
+	db := useTestDB(t)
+	now := time.Now().Unix()
+	assert.NoError(t, db.Create(&accessdb.Location{Name: "F1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+	assert.NoError(t, db.Create(&accessdb.M5Stick{Mac: "00:00:00:00:00:09", RoleId: 1, LocationId: 1}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.EnrollmentCode{
+		{Code: "VALID23456", RoleId: 1, LocationId: 1, ExpiresAt: now + 60},
+		{Code: "EXPIRED234", RoleId: 1, LocationId: 1, ExpiresAt: now - 1},
+		{Code: "USED234567", RoleId: 1, LocationId: 1, ExpiresAt: now + 60, UsedAt: now - 10},
+		{Code: "TAKEN23456", RoleId: 1, LocationId: 1, ExpiresAt: now + 60},
+	}).Error)
+
+	router := gin.New()
+	router.POST("/m5sticks/enroll", handlers.EnrollM5Stick)
+	tests := []struct {
+		name   string
+		mac    string
+		code   string
+		status int
+	}{
+		{name: "unknown code", mac: "00:00:00:00:00:01", code: "UNKNOWN234", status: http.StatusNotFound},
+		{name: "expired code", mac: "00:00:00:00:00:01", code: "EXPIRED234", status: http.StatusGone},
+		{name: "used code", mac: "00:00:00:00:00:01", code: "USED234567", status: http.StatusGone},
+		{name: "registered mac", mac: "00:00:00:00:00:09", code: "TAKEN23456", status: http.StatusConflict},
+		{name: "lowercase code", mac: "00:00:00:00:00:01", code: "valid23456", status: http.StatusOK},
+		{name: "code used twice", mac: "00:00:00:00:00:02", code: "VALID23456", status: http.StatusGone},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"mac": %q, "code": %q}`, tt.mac, tt.code)
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/m5sticks/enroll", strings.NewReader(body)))
+		assert.Equal(t, tt.status, w.Code, tt.name)
+	}
+
+	// The enrolled M5stick authenticates with the issued token only.
+	var m5Stick accessdb.M5Stick
+	assert.NoError(t, db.Where("mac = ?", "00:00:00:00:00:01").First(&m5Stick).Error)
+	assert.NotEmpty(t, m5Stick.TokenHash)
+	status, err := accessdb.VerifyM5StickToken("00:00:00:00:00:01", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Error(t, err)
+}
+
+func TestM5StickConfigETag(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.Location{Name: "F1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+	assert.NoError(t, db.Create(&accessdb.M5Stick{Mac: "00:00:00:00:00:01", RoleId: 1, LocationId: 1}).Error)
+
+	router := gin.New()
+	router.GET("/m5sticks/:mac/config", handlers.GetM5StickConfig)
+	router.PUT("/m5sticks/:mac/config", handlers.UpdateM5StickConfig)
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/m5sticks/00:00:00:00:00:01/config", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	tests := []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{ifNoneMatch: etag, status: http.StatusNotModified},
+		{ifNoneMatch: "W/" + etag, status: http.StatusNotModified},
+		{ifNoneMatch: `"other", ` + etag, status: http.StatusNotModified},
+		{ifNoneMatch: "*", status: http.StatusNotModified},
+		{ifNoneMatch: `"other"`, status: http.StatusOK},
+		{ifNoneMatch: strings.Trim(etag, `"`), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := get(tt.ifNoneMatch)
+		assert.Equal(t, tt.status, w.Code, tt.ifNoneMatch)
+		assert.Equal(t, etag, w.Header().Get("ETag"), tt.ifNoneMatch)
+		if tt.status == http.StatusNotModified {
+			assert.Empty(t, w.Body.String(), tt.ifNoneMatch)
+		}
+	}
+
+	// A changed configuration gets a new ETag, so the M5stick polling with the old one gets it.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/m5sticks/00:00:00:00:00:01/config", strings.NewReader(`{"messages": {"idle": "Hello"}, "tap_cooldown": 5}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = get(etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	assert.Contains(t, w.Body.String(), `"Hello"`)
+}
+
+func TestGetUnhealthyM5Sticks(t *testing.T) {
+	db := useTestDB(t)
+	now := time.Now().Unix()
+	low, full := 10, 90
+	assert.NoError(t, db.Create(&accessdb.Location{Name: "F1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.M5Stick{
+		{Mac: "00:00:00:00:00:01", RoleId: 1, LocationId: 1, LastSeen: now, Battery: &low},
+		{Mac: "00:00:00:00:00:02", RoleId: 1, LocationId: 1, LastSeen: now, Battery: &full},
+		{Mac: "00:00:00:00:00:03", RoleId: 1, LocationId: 1, LastSeen: now},
+		{Mac: "00:00:00:00:00:04", RoleId: 1, LocationId: 1, LastSeen: now - 600},
+	}).Error)
+
+	m5Sticks, err := accessdb.GetUnhealthyM5SticksFromDB(now-300, 20, "")
+	assert.NoError(t, err)
+	var macs []string
+	for _, m := range m5Sticks {
+		macs = append(macs, m.Mac)
+	}
+	// The M5stick that has not reported its battery is not low on it.
+	assert.Equal(t, []string{"00:00:00:00:00:01", "00:00:00:00:00:04"}, macs)
+	assert.Nil(t, m5Sticks[1].Battery)
+}
+
+func TestDeleteShiftsInRange(t *testing.T) {
+	locationF1, locationF2 := 1, 2
+	slotF1, slotF2 := uint(1), uint(2)
+	tests := []struct {
+		name     string
+		start    string
+		end      string
+		login    string
+		location string
+		deleted  []uint
+	}{
+		{name: "range", start: "2024-06-01", end: "2024-06-02", deleted: []uint{1, 2, 3, 4}},
+		{name: "single day", start: "2024-06-02", end: "2024-06-02", deleted: []uint{3, 4}},
+		{name: "login", start: "2024-06-01", end: "2024-06-03", login: "tanemura", deleted: []uint{2, 4}},
+		{name: "location", start: "2024-06-01", end: "2024-06-03", location: "F1", deleted: []uint{2, 5}},
+		{name: "login and location", start: "2024-06-01", end: "2024-06-03", login: "kakiba", location: "F1", deleted: []uint{5}},
+		{name: "nothing in range", start: "2024-07-01", end: "2024-07-31", deleted: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := useTestDB(t)
+			assert.NoError(t, db.Create(&[]accessdb.User{{Login: "kakiba"}, {Login: "tanemura"}}).Error)
+			assert.NoError(t, db.Create(&[]accessdb.Location{{Name: "F1"}, {Name: "F2"}}).Error)
+			assert.NoError(t, db.Create(&[]accessdb.Slot{{ID: slotF1, Date: "2024-06-01", LocationId: &locationF1}, {ID: slotF2, Date: "2024-06-02", LocationId: &locationF2}}).Error)
+			assert.NoError(t, db.Create(&[]accessdb.Shift{
+				{ID: 1, Date: "2024-06-01", UserID: 1},
+				{ID: 2, Date: "2024-06-01", UserID: 2, SlotID: &slotF1},
+				{ID: 3, Date: "2024-06-02", UserID: 1, SlotID: &slotF2},
+				{ID: 4, Date: "2024-06-02", UserID: 2},
+				{ID: 5, Date: "2024-06-03", UserID: 1, SlotID: &slotF1},
+			}).Error)
+
+			status, shifts, err := accessdb.DeleteShiftsInRangeFromDB(tt.start, tt.end, tt.login, tt.location, "Holiday", accessdb.Audit{Actor: "staff"})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, status)
+			var ids []uint
+			for _, shift := range shifts {
+				assert.True(t, shift.DeletedAt.Valid)
+				assert.Equal(t, "Holiday", shift.DeleteReason)
+				ids = append(ids, shift.ID)
+			}
+			assert.Equal(t, tt.deleted, ids)
+
+			var remaining int64
+			assert.NoError(t, db.Model(&accessdb.Shift{}).Count(&remaining).Error)
+			assert.Equal(t, int64(5-len(tt.deleted)), remaining)
+		})
+	}
+}
+
+func TestDeleteShiftRangeNotFound(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.User{Login: "kakiba"}).Error)
+	router := gin.New()
+	router.DELETE("/shifts/range", handlers.DeleteShiftRangeData)
+
+	tests := []struct {
+		body   string
+		status int
+		error  string
+	}{
+		{`{"start": "2024-06-01", "end": "2024-06-02", "login": "nobody"}`, http.StatusNotFound, "User not found: nobody"},
+		{`{"start": "2024-06-01", "end": "2024-06-02", "location": "F9"}`, http.StatusNotFound, "Location not found: F9"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", "/shifts/range", strings.NewReader(tt.body)))
+		assert.Equal(t, tt.status, w.Code, tt.body)
+		assert.JSONEq(t, fmt.Sprintf(`{"error":%q}`, tt.error), w.Body.String(), tt.body)
+	}
+
+	// A failure of the DB is not a bad request.
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/shifts/range", strings.NewReader(`{"start": "2024-06-01", "end": "2024-06-02"}`)))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"error":"Failed to delete shifts"}`, w.Body.String())
+}
+
+func TestDeleteShiftRangeValidation(t *testing.T) {
+	router := gin.New()
+	router.DELETE("/shifts/range", handlers.DeleteShiftRangeData)
+
+	tests := []struct {
+		body string
+	}{
+		{body: `{"end": "2024-06-02"}`},
+		{body: `{"start": "2024/06/01", "end": "2024-06-02"}`},
+		{body: `{"start": "2024-06-03", "end": "2024-06-02"}`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", "/shifts/range", strings.NewReader(tt.body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.body)
+	}
+}
+
+func TestSoftDeleteAndRestoreShift(t *testing.T) {
+	db := useTestDB(t)
+
+	slotId := uint(1)
+	assert.NoError(t, db.Create(&accessdb.User{Login: "kakiba"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Slot{ID: slotId, Date: "2024-06-01", StartTime: "10:00", Capacity: 1}).Error)
+	assert.NoError(t, db.Create(&accessdb.Shift{Date: "2024-06-01", UserID: 1}).Error)
+	assert.NoError(t, db.Create(&accessdb.Shift{Date: "2024-06-01", UserID: 1, SlotID: &slotId}).Error)
+
+	deleter := accessdb.Audit{Actor: "staff1"}
+	status, _, err := accessdb.DeleteShiftFromDB("kakiba", "2024-06-01", nil, 0, "Holiday", deleter)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Error(t, err)
+
+	status, deleted, err := accessdb.DeleteShiftFromDB("kakiba", "2024-06-01", &slotId, 0, "Holiday", deleter)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, deleted.DeletedAt.Valid)
+	assert.Equal(t, "staff1", deleted.DeletedBy)
+	assert.Equal(t, "Holiday", deleted.DeleteReason)
+	assert.Equal(t, 1, deleted.Revision)
+
+	shifts, err := accessdb.GetShiftFromDB("2024-06-01")
+	assert.NoError(t, err)
+	assert.Len(t, shifts, 1)
+	deletedShifts, err := accessdb.GetDeletedShiftsFromDB("2024-06-01", "2024-06-01")
+	assert.NoError(t, err)
+	assert.Len(t, deletedShifts, 1)
+
+	status, restored, err := accessdb.RestoreShiftOnDB(deleted.ID, accessdb.Audit{Actor: "staff2"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.False(t, restored.DeletedAt.Valid)
+	assert.Equal(t, "staff1", restored.DeletedBy)
+	assert.Equal(t, "Holiday", restored.DeleteReason)
+	assert.Equal(t, "staff2", restored.RestoredBy)
+	assert.NotZero(t, restored.RestoredAt)
+	assert.Equal(t, 2, restored.Revision)
+
+	status, _, err = accessdb.RestoreShiftOnDB(deleted.ID, accessdb.Audit{Actor: "staff2"})
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Error(t, err)
+
+	var entries []accessdb.AuditLog
+	assert.NoError(t, db.Where("entity_type = ?", "shift").Order("id").Find(&entries).Error)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "shift.restore", entries[1].Action)
+	assert.Equal(t, "staff2", entries[1].Actor)
+	var outboxEvents []accessdb.OutboxEvent
+	assert.NoError(t, db.Order("id").Find(&outboxEvents).Error)
+	assert.Len(t, outboxEvents, 2)
+	assert.Equal(t, "shift.deleted", outboxEvents[0].Type)
+	assert.Equal(t, "shift.restored", outboxEvents[1].Type)
+}
+
+func TestExchangeShifts(t *testing.T) {
+	db := useTestDB(t)
+
+	slotId := uint(1)
+	assert.NoError(t, db.Create(&[]accessdb.User{{Login: "kakiba"}, {Login: "tanemura"}}).Error)
+	assert.NoError(t, db.Create(&accessdb.Slot{ID: slotId, Date: "2024-06-01", StartTime: "10:00", Capacity: 1}).Error)
+	assert.NoError(t, db.Create(&accessdb.Shift{Date: "2024-06-01", UserID: 1}).Error)
+	assert.NoError(t, db.Create(&accessdb.Shift{Date: "2024-06-01", UserID: 1, SlotID: &slotId}).Error)
+	assert.NoError(t, db.Create(&accessdb.Shift{Date: "2024-06-02", UserID: 2}).Error)
+
+	audit := accessdb.Audit{Actor: "staff1"}
+	status, _, _, err := accessdb.ExchangeShiftsOnDB("kakiba", "tanemura", "2024-06-01", "2024-06-02", nil, nil, 0, 0, audit)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Error(t, err)
+	status, _, _, err = accessdb.ExchangeShiftsOnDB("kakiba", "nobody", "2024-06-01", "2024-06-02", &slotId, nil, 0, 0, audit)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.EqualError(t, err, "User not found: nobody")
+	status, _, _, err = accessdb.ExchangeShiftsOnDB("kakiba", "tanemura", "2024-06-01", "2024-06-02", &slotId, nil, 0, 4, audit)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Error(t, err)
+
+	status, shift1, shift2, err := accessdb.ExchangeShiftsOnDB("kakiba", "tanemura", "2024-06-01", "2024-06-02", &slotId, nil, 0, 3, audit)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, uint(2), shift1.ID)
+	assert.Equal(t, "tanemura", shift1.User.Login)
+	assert.Equal(t, uint(3), shift2.ID)
+	assert.Equal(t, "kakiba", shift2.User.Login)
+
+	// The other shift of the day is left as it was.
+	var other accessdb.Shift
+	assert.NoError(t, db.First(&other, 1).Error)
+	assert.Equal(t, 1, other.UserID)
+}
+
+func TestClaimAndReleaseSlotAreRecorded(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.User{Login: "user1"}).Error)
+	date := time.Now().AddDate(0, 0, 7).Format("2006-01-02")
+	assert.NoError(t, db.Create(&accessdb.Slot{Date: date, StartTime: "10:00", Capacity: 2, Open: true}).Error)
+
+	status, shift, err := accessdb.ClaimSlotOnDB(1, "user1", time.Hour, accessdb.Audit{Actor: "user1"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	_, _, err = accessdb.ReleaseSlotOnDB(1, "user1", time.Hour, accessdb.Audit{Actor: "user1"})
+	assert.NoError(t, err)
+
+	var outboxEvents []accessdb.OutboxEvent
+	assert.NoError(t, db.Order("id").Find(&outboxEvents).Error)
+	assert.Len(t, outboxEvents, 2)
+	assert.Equal(t, "shift.created", outboxEvents[0].Type)
+	assert.Equal(t, "shift.deleted", outboxEvents[1].Type)
+	var entries []accessdb.AuditLog
+	assert.NoError(t, db.Where("entity_type = ? AND entity_id = ?", "shift", fmt.Sprint(shift.ID)).Order("id").Find(&entries).Error)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "shift.claim", entries[0].Action)
+	assert.Equal(t, "", entries[0].Before)
+	assert.Equal(t, "shift.release", entries[1].Action)
+	assert.Equal(t, "user1", entries[1].Actor)
+}
+
+func TestAddShiftIsRecorded(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&[]accessdb.User{{Login: "user1"}, {Login: "user2"}}).Error)
+
+	status, dates, err := accessdb.AddShiftToDB([]accessdb.Schedule{{Date: "2024-06-01", Login: []string{"user1", "user2"}}}, accessdb.Audit{Actor: "staff1"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"2024-06-01"}, dates)
+	// Adding the same shifts again records nothing.
+	_, _, err = accessdb.AddShiftToDB([]accessdb.Schedule{{Date: "2024-06-01", Login: []string{"user1"}}}, accessdb.Audit{Actor: "staff1"})
+	assert.NoError(t, err)
+
+	var outboxEvents []accessdb.OutboxEvent
+	assert.NoError(t, db.Order("id").Find(&outboxEvents).Error)
+	assert.Len(t, outboxEvents, 2)
+	assert.Equal(t, "shift.created", outboxEvents[0].Type)
+	var entries []accessdb.AuditLog
+	assert.NoError(t, db.Where("entity_type = ?", "shift").Order("id").Find(&entries).Error)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "shift.create", entries[0].Action)
+	assert.Equal(t, "", entries[0].Before)
+	assert.Equal(t, "staff1", entries[0].Actor)
+}
+
+func TestRequireStaff(t *testing.T) {
+	router := gin.New()
+	router.POST("/staff", handlers.RequireStaff(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	t.Setenv("STAFF_LOGINS", "")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/staff", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	t.Setenv("STAFF_LOGINS", "staff1, staff2")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/staff", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// Answers the requests to the 42 intra API as the user with the login, in place of the real API.
+type intraStub struct {
+	login string
+}
+
+func (s intraStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := fmt.Sprintf(`{"login":%q}`, s.login)
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header), Request: req}, nil
+}
+
+func TestStaffOnlyRoutes(t *testing.T) {
+	transport := http.DefaultTransport
+	http.DefaultTransport = intraStub{login: "user1"}
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	t.Setenv("STAFF_LOGINS", "staff1")
+	router := gin.New()
+	registerRoutes(router)
+
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/firmwares"},
+		{"PUT", "/roles/Cleaning/firmware"},
+		{"PUT", "/m5sticks/00:00:00:00:00:01/firmware"},
+		{"POST", "/m5sticks/enrollment-codes"},
+		{"PUT", "/points/rules"},
+		{"POST", "/points/accrue"},
+		{"GET", "/shifts/missed"},
+		{"POST", "/shifts/missed/check"},
+		{"PUT", "/m5sticks/00:00:00:00:00:01/config"},
+		{"GET", "/m5sticks/health"},
+		{"GET", "/activities/pending"},
+		{"POST", "/shifts/slots"},
+	}
+	for _, route := range routes {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(route.method, route.path, nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, route.method+" "+route.path)
+
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest(route.method, route.path, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, route.method+" "+route.path)
+	}
+}
+
+func TestDeleteShiftWithoutStaffLogins(t *testing.T) {
+	t.Setenv("STAFF_LOGINS", "")
+	router := gin.New()
+	registerRoutes(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/shifts", strings.NewReader(`{"login":"user1","date":"2024-06-01"}`)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"error":"Staff logins are not configured"}`, w.Body.String())
+}
+
+func TestRankLeaderboard(t *testing.T) {
+	entries := accessdb.RankLeaderboard(map[string]int64{"carol": 3, "alice": 5, "bob": 5, "dave": 1})
+	assert.Equal(t, []accessdb.LeaderboardEntry{
+		{Rank: 1, Login: "alice", Value: 5},
+		{Rank: 1, Login: "bob", Value: 5},
+		{Rank: 3, Login: "carol", Value: 3},
+		{Rank: 4, Login: "dave", Value: 1},
+	}, entries)
+}
+
+func TestLeaderboardInvalidateDuringGet(t *testing.T) {
+	var mu sync.Mutex
+	computed := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache := leaderboard.NewCache(func(key leaderboard.Key, start int64, end int64) ([]accessdb.LeaderboardEntry, error) {
+		mu.Lock()
+		computed++
+		first := computed == 1
+		mu.Unlock()
+		if first {
+			close(started)
+			<-release
+			return []accessdb.LeaderboardEntry{{Rank: 1, Login: "opted_out", Value: 1}}, nil
+		}
+		return []accessdb.LeaderboardEntry{}, nil
+	})
+	key := leaderboard.Key{Period: "all", Metric: "count"}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := cache.Get(key)
+		assert.NoError(t, err)
+	}()
+	<-started
+	cache.Invalidate()
+	close(release)
+	<-done
+
+	// The board computed before Invalidate is not kept.
+	board, err := cache.Get(key)
+	assert.NoError(t, err)
+	assert.Empty(t, board.Entries)
+	assert.Equal(t, 2, computed)
+}
+
+func TestGetLeaderboardFromDB(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&[]accessdb.Location{{Name: "F1"}}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.Role{{Name: "Cleaning"}, {Name: "Guide"}}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.User{{Login: "user1"}, {Login: "user2"}, {Login: "user3", LeaderboardOff: true}}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.M5Stick{
+		{Mac: "00:00:00:00:00:01", RoleId: 1, LocationId: 1},
+		{Mac: "00:00:00:00:00:02", RoleId: 2, LocationId: 1},
+	}).Error)
+	day := time.Date(2024, 6, 3, 9, 0, 0, 0, time.Local).Unix()
+	activities := []accessdb.Activity{
+		{UserID: 1, M5StickID: 1, CreatedAt: day},
+		{UserID: 1, M5StickID: 1, CreatedAt: day + 600},
+		{UserID: 1, M5StickID: 1, CreatedAt: day + 3600},
+		{UserID: 2, M5StickID: 1, CreatedAt: day + 100},
+		{UserID: 2, M5StickID: 2, CreatedAt: day + 200},
+		{UserID: 2, M5StickID: 1, CreatedAt: day + 1300},
+		{UserID: 2, M5StickID: 2, CreatedAt: day + 24*60*60},
+		{UserID: 3, M5StickID: 1, CreatedAt: day},
+		{UserID: 3, M5StickID: 1, CreatedAt: day + 60},
+	}
+	assert.NoError(t, db.Create(&activities).Error)
+	var sessions []accessdb.Activity
+	assert.NoError(t, db.Preload("User").Preload("M5Stick").Where("user_id <> ?", 3).Find(&sessions).Error)
+
+	entries, err := accessdb.GetLeaderboardFromDB("", 0, day+2*24*60*60, "count")
+	assert.NoError(t, err)
+	assert.Equal(t, []accessdb.LeaderboardEntry{{Rank: 1, Login: "user2", Value: 4}, {Rank: 2, Login: "user1", Value: 3}}, entries)
+
+	// The sessions paired in SQL last as long as the ones PairSessions pairs in Go.
+	entries, err = accessdb.GetLeaderboardFromDB("", 0, day+2*24*60*60, "duration")
+	assert.NoError(t, err)
+	assert.Equal(t, []accessdb.LeaderboardEntry{{Rank: 1, Login: "user2", Value: 1200}, {Rank: 2, Login: "user1", Value: 600}}, entries)
+	var total int64
+	for _, s := range accessdb.PairSessions(sessions) {
+		total += s.Duration()
+	}
+	assert.Equal(t, int64(1800), total)
+
+	entries, err = accessdb.GetLeaderboardFromDB("Guide", 0, day+2*24*60*60, "duration")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	router := gin.New()
+	router.GET("/leaderboards", handlers.GetLeaderboard)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/leaderboards?role=Unknown", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error":"Role not found"}`, w.Body.String())
+}
+
+func TestActivityStatGroup(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	group, ok := accessdb.ActivityStatGroup("day", time.Date(2024, 4, 1, 0, 0, 0, 0, tokyo), time.Date(2024, 5, 1, 0, 0, 0, 0, tokyo))
+	assert.True(t, ok)
+	assert.Equal(t, "DATE_FORMAT(DATE_ADD('1970-01-01 00:00:00', INTERVAL activities.created_at + 32400 SECOND), '%Y-%m-%d')", group)
+	pst := time.FixedZone("PST", -8*60*60)
+	group, ok = accessdb.ActivityStatGroup("week", time.Date(2024, 4, 1, 0, 0, 0, 0, pst), time.Date(2024, 4, 2, 0, 0, 0, 0, pst))
+	assert.True(t, ok)
+	assert.Contains(t, group, "activities.created_at + -28800 SECOND), '%x-W%v')")
+	group, ok = accessdb.ActivityStatGroup("role", time.Now(), time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, "roles.name", group)
+	_, ok = accessdb.ActivityStatGroup("year", time.Now(), time.Now())
+	assert.False(t, ok)
+}
+
+func TestLocalOffsetSQL(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	db := useTestDB(t)
+	start := time.Date(2024, 10, 1, 0, 0, 0, 0, paris)
+	end := time.Date(2024, 11, 1, 0, 0, 0, 0, paris)
+	offset := accessdb.LocalOffsetSQL("t", start, end)
+	// Summer time ends at 01:00 UTC on 2024-10-27.
+	assert.Equal(t, "(CASE WHEN t < 1729990800 THEN 7200 ELSE 3600 END)", offset)
+
+	for _, at := range []time.Time{start, time.Unix(1729990799, 0), time.Unix(1729990800, 0), end.Add(-time.Second)} {
+		var seconds int
+		assert.NoError(t, db.Raw("SELECT "+offset+" FROM (SELECT ? AS t)", at.Unix()).Scan(&seconds).Error)
+		_, expected := at.In(paris).Zone()
+		assert.Equal(t, expected, seconds, at)
+	}
+	assert.Equal(t, "3600", accessdb.LocalOffsetSQL("t", end, end.AddDate(0, 1, 0)))
+	// Each year of the range adds the two changes of that year.
+	offset = accessdb.LocalOffsetSQL("t", start, start.AddDate(5, 0, 0))
+	assert.Equal(t, 10, strings.Count(offset, "WHEN"))
+}
+
+func TestGetActivityStats(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&[]accessdb.Location{{Name: "F1"}, {Name: "F2"}}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.Role{{Name: "Cleaning"}, {Name: "Guide"}}).Error)
+	// user2 opted out of the leaderboard, so it is counted but not listed by user.
+	assert.NoError(t, db.Create(&[]accessdb.User{{Login: "user1"}, {Login: "user2", LeaderboardOff: true}}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.M5Stick{
+		{Mac: "00:00:00:00:00:01", RoleId: 1, LocationId: 1},
+		{Mac: "00:00:00:00:00:02", RoleId: 2, LocationId: 2},
+	}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.Activity{
+		{UserID: 1, M5StickID: 1, CreatedAt: 1000},
+		{UserID: 1, M5StickID: 1, CreatedAt: 1100},
+		{UserID: 2, M5StickID: 1, CreatedAt: 1200},
+		{UserID: 2, M5StickID: 2, CreatedAt: 1300},
+		{UserID: 1, M5StickID: 2, CreatedAt: 5000},
+	}).Error)
+
+	router := gin.New()
+	router.GET("/stats/activities", handlers.GetActivityStats)
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"start=0&end=2000&group_by=role", http.StatusOK, `{"end":2000,"group_by":"role","start":0,"stats":[{"group":"Cleaning","count":3,"users":2},{"group":"Guide","count":1,"users":1}],"total":4}`},
+		{"start=0&end=6000&group_by=user&location=F2", http.StatusOK, `{"end":6000,"group_by":"user","start":0,"stats":[{"group":"user1","count":1,"users":1}],"total":1}`},
+		{"start=0&end=2000&group_by=user", http.StatusOK, `{"end":2000,"group_by":"user","start":0,"stats":[{"group":"user1","count":2,"users":1}],"total":2}`},
+		{"start=0&end=2000&group_by=location&login=user1", http.StatusOK, `{"end":2000,"group_by":"location","start":0,"stats":[{"group":"F1","count":2,"users":1}],"total":2}`},
+		{"start=0&end=2000&group_by=year", http.StatusBadRequest, `{"error":"group_by must be one of day, week, month, role, location, and user"}`},
+		{"start=2000&end=1000", http.StatusBadRequest, `{"error":"Invalid query"}`},
+		{"start=0&end=9223372036854775807", http.StatusBadRequest, `{"error":"The time range must be at most five years long"}`},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/stats/activities?"+test.query, nil))
+		assert.Equal(t, test.status, w.Code, test.query)
+		assert.JSONEq(t, test.body, w.Body.String(), test.query)
+	}
+}
+
+func TestPointRulesAndBalances(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+	assert.NoError(t, db.Create(&accessdb.User{Login: "user1", Wallet: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"}).Error)
+	assert.NoError(t, db.Create(&accessdb.PointEntry{UserID: 1, Points: 10, Kind: "adjustment"}).Error)
+
+	router := gin.New()
+	router.PUT("/points/rules", handlers.SetPointRule)
+	router.GET("/points/balances", handlers.GetBalances)
+	for _, body := range []string{`{"role":"Cleaning","per_session":-1}`, `{"role":"Cleaning","per_hour":-1}`, `{"role":"Cleaning","per_shift":-1}`} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PUT", "/points/rules", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		assert.JSONEq(t, `{"error":"Points must not be negative"}`, w.Body.String(), body)
+	}
+
+	// The balances are public, so the wallets are left out.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/points/balances", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"balances":[{"login":"user1","balance":10}]}`, w.Body.String())
+}
+
+func TestPayoutRecipients(t *testing.T) {
+	items := []accessdb.PayoutItem{
+		{UserID: 1, Wallet: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", Amount: 30},
+		{UserID: 2, Wallet: "", Amount: 20, Flag: "missing_wallet"},
+		{UserID: 3, Wallet: "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", Amount: 10},
+		{UserID: 4, Wallet: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", Amount: 5},
+	}
+	assert.Equal(t, []accessdb.PayoutRecipient{
+		{Address: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", Amount: 35},
+		{Address: "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", Amount: 10},
+	}, accessdb.PayoutRecipients(items))
+}
+
+func TestPayoutBatchPaysUnpaidEntries(t *testing.T) {
+	db := useTestDB(t)
+	day := func(date string) int64 {
+		d, _ := time.ParseInLocation("2006-01-02", date, time.Local)
+		return d.Add(12 * time.Hour).Unix()
+	}
+	db.Create(&accessdb.User{ID: 1, Login: "user1", Wallet: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", WalletVerified: true})
+	db.Create(&accessdb.User{ID: 2, Login: "user2"})
+	db.Create(&accessdb.PointEntry{UserID: 1, Points: 10, Kind: "adjustment", CreatedAt: day("2024-05-10")})
+	db.Create(&accessdb.PointEntry{UserID: 2, Points: 7, Kind: "adjustment", CreatedAt: day("2024-05-10")})
+
+	status, batch, err := accessdb.AddPayoutBatchToDB("2024-05-31", 1, "staff1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "2024-05-10", batch.StartDate)
+	assert.Len(t, batch.Items, 2)
+	_, _, err = accessdb.ApprovePayoutBatchOnDB(batch.ID, "staff1")
+	assert.NoError(t, err)
+
+	// A late adjustment in the paid period and the points of the user who had no wallet go to the next batch.
+	db.Create(&accessdb.PointEntry{UserID: 1, Points: 3, Kind: "adjustment", CreatedAt: day("2024-05-20")})
+	db.Model(&accessdb.User{}).Where("id = ?", 2).Updates(map[string]interface{}{"wallet": "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", "wallet_verified": true})
+	status, _, err = accessdb.AddPayoutBatchToDB("2024-05-31", 1, "staff1")
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Error(t, err)
+	_, next, err := accessdb.AddPayoutBatchToDB("2024-06-30", 1, "staff1")
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-06-01", next.StartDate)
+	assert.Equal(t, []accessdb.PayoutRecipient{
+		{Address: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", Amount: 3},
+		{Address: "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", Amount: 7},
+	}, accessdb.PayoutRecipients(sortedItems(next.Items)))
+
+	// Recalculating keeps the same entries, and deleting the draft leaves them unpaid.
+	_, next, err = accessdb.RecalculatePayoutBatchOnDB(next.ID, 1)
+	assert.NoError(t, err)
+	assert.Len(t, next.Items, 2)
+	status, err = accessdb.DeletePayoutBatchFromDB(next.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	var unpaid int64
+	db.Model(&accessdb.PointEntry{}).Where("payout_batch_id IS NULL").Count(&unpaid)
+	assert.Equal(t, int64(2), unpaid)
+}
+
+func TestAddPayoutBatch(t *testing.T) {
+	useTestDB(t)
+	router := gin.New()
+	router.POST("/payouts", handlers.AddPayoutBatch)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/payouts", strings.NewReader(`{"end": "2024/05/31"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/payouts", strings.NewReader(`{"end": "2024-05-31"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// Sort the payout items by user, as the order of a grouped query is not defined.
+func sortedItems(items []accessdb.PayoutItem) []accessdb.PayoutItem {
+	sort.Slice(items, func(i, j int) bool { return items[i].UserID < items[j].UserID })
+	return items
+}
+
+func TestNormalizeWalletAddress(t *testing.T) {
+	address, err := wallet.NormalizeAddress("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed")
+	assert.NoError(t, err)
+	assert.Equal(t, "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", address)
+
+	_, err = wallet.NormalizeAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD")
+	assert.Error(t, err)
+	_, err = wallet.NormalizeAddress("0x5aaeb6053f3e94c9b9a09f33669435e7ef1bea")
+	assert.Error(t, err)
+}
+
+func TestRecoverWalletAddress(t *testing.T) {
+	message := "42ActivityAPI wallet verification"
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+	key := secp256k1.PrivKeyFromBytes([]byte{31: 1})
+	compact := ecdsa.SignCompact(key, hash.Sum(nil), false)
+	// personal_sign puts the recovery id last as 27 or 28.
+	signature := append(compact[1:], compact[0])
+
+	address, err := wallet.RecoverAddress(message, "0x"+hex.EncodeToString(signature))
+	assert.NoError(t, err)
+	assert.Equal(t, "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", address)
+
+	address, err = wallet.RecoverAddress(message+".", "0x"+hex.EncodeToString(signature))
+	assert.NoError(t, err)
+	assert.NotEqual(t, "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", address)
+}
+
+func TestVerifyWalletIsAudited(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.User{Login: "kakiba"}).Error)
+	challenge, err := accessdb.AddWalletChallengeToDB("kakiba", "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", time.Minute)
+	assert.NoError(t, err)
+
+	message := challenge.Message("kakiba")
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+	compact := ecdsa.SignCompact(secp256k1.PrivKeyFromBytes([]byte{31: 1}), hash.Sum(nil), false)
+	signature := append(compact[1:], compact[0])
+
+	status, user, err := accessdb.VerifyWalletOnDB("kakiba", "0x"+hex.EncodeToString(signature), accessdb.Audit{Actor: "kakiba"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, user.WalletVerified)
+
+	var entry accessdb.AuditLog
+	assert.NoError(t, db.Where("entity_type = ? AND entity_id = ?", "user", "kakiba").First(&entry).Error)
+	assert.Equal(t, "user.wallet_verify", entry.Action)
+	assert.Equal(t, "kakiba", entry.Actor)
+	assert.Contains(t, entry.Diff, `"WalletVerified":{"before":false,"after":true}`)
+}
+
+func TestBuildICalendar(t *testing.T) {
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	events := []icalendar.Event{
+		{UID: "shift-1@42activityapi", Summary: "Cleaning, F1", Start: start, End: start.Add(time.Hour)},
+		{UID: "shift-2@42activityapi", Summary: "Shift", Start: start, End: start.AddDate(0, 0, 1), AllDay: true, Cancelled: true, Sequence: 2},
+	}
+	calendar := icalendar.Build("Shifts", events, start)
+
+	assert.True(t, strings.HasPrefix(calendar, "BEGIN:VCALENDAR\r\n"))
+	assert.Contains(t, calendar, "DTSTART:20240601T100000Z\r\n")
+	assert.Contains(t, calendar, "SUMMARY:Cleaning\\, F1\r\n")
+	assert.Contains(t, calendar, "DTSTART;VALUE=DATE:20240601\r\nDTEND;VALUE=DATE:20240602\r\n")
+	assert.Contains(t, calendar, "STATUS:CONFIRMED\r\nSEQUENCE:0\r\n")
+	assert.Contains(t, calendar, "STATUS:CANCELLED\r\nSEQUENCE:2\r\n")
+
+	long := icalendar.Build(strings.Repeat("a", 200), nil, start)
+	for _, line := range strings.Split(long, "\r\n") {
+		assert.LessOrEqual(t, len(line), 75)
+	}
+}
+
+// Start an embedded MQTT broker and return its address.
+func startTestBroker(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mochi.New(nil)
+	server.AddHook(new(auth.AllowHook), nil)
+	if err := server.AddListener(listeners.NewNet("test", listener)); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestMQTTIngestion(t *testing.T) {
+	broker := startTestBroker(t)
+
+	type tap struct{ mac, uid, token string }
+	taps := make(chan tap, 2)
+	config := mqttingest.Config{Broker: broker, ClientID: "api", TopicPrefix: "m5sticks", RetryBackoff: time.Hour}
+	subscriber, err := mqttingest.Start(config, func(mac string, uid string, token string) (int, error) {
+		taps <- tap{mac, uid, token}
+		if uid == "broken" {
+			return http.StatusInternalServerError, errors.New("DB is down")
+		}
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("m5stick"))
+	if token := device.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer device.Disconnect(0)
+	// A tap that fails waits for its retry, and the next one is still received in the meantime.
+	for _, payload := range []string{`{"uid":"broken","token":"secret"}`, `{"uid":"foo","token":"secret"}`} {
+		if token := device.Publish("m5sticks/00:00:00:00:00:00/taps", 1, false, payload); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+	}
+
+	for _, expected := range []tap{{"00:00:00:00:00:00", "broken", "secret"}, {"00:00:00:00:00:00", "foo", "secret"}} {
+		select {
+		case received := <-taps:
+			assert.Equal(t, expected, received)
+		case <-time.After(5 * time.Second):
+			t.Fatal("tap was not received")
+		}
+	}
+}
+
+func TestMQTTRedelivery(t *testing.T) {
+	broker := startTestBroker(t)
+	config := mqttingest.Config{Broker: broker, ClientID: "api", TopicPrefix: "m5sticks", RetryBackoff: 10 * time.Millisecond}
+
+	var mu sync.Mutex
+	failures := 2
+	var recorded []string
+	received := make(chan string, 8)
+	handle := func(mac string, uid string, token string) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		received <- uid
+		if failures > 0 && uid == "foo" {
+			failures--
+			return http.StatusInternalServerError, errors.New("DB is down")
+		}
+		recorded = append(recorded, uid)
+		return http.StatusOK, nil
+	}
+	expect := func(uid string) {
+		select {
+		case got := <-received:
+			assert.Equal(t, uid, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("tap was not received: " + uid)
+		}
+	}
+
+	subscriber, err := mqttingest.Start(config, handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("m5stick"))
+	if token := device.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer device.Disconnect(0)
+	publish := func(payload string) {
+		if token := device.Publish("m5sticks/00:00:00:00:00:00/taps", 1, false, payload); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+	}
+
+	publish(`{"uid":"bar","token":"secret","timestamp":1717236000}`)
+	expect("bar")
+	// The failed tap is retried by the same subscriber until it is recorded.
+	publish(`{"uid":"foo","token":"secret","timestamp":1717236001}`)
+	expect("foo")
+	expect("foo")
+	expect("foo")
+
+	// The same tap sent again by the M5stick is not recorded twice.
+	publish(`{"uid":"foo","token":"secret","timestamp":1717236001}`)
+	publish(`{"uid":"baz","token":"secret","timestamp":1717236002}`)
+	expect("baz")
+
+	// Every tap was acknowledged, so a new session of the subscriber gets none of them again.
+	subscriber.Close()
+	subscriber, err = mqttingest.Start(config, handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	select {
+	case uid := <-received:
+		t.Fatal("tap was delivered again: " + uid)
+	case <-time.After(500 * time.Millisecond):
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"bar", "foo", "baz"}, recorded)
+}
+
+func TestAddActivityFeedback(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&[]accessdb.Location{{Name: "F1"}, {Name: "F2"}}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.Role{{Name: "Cleaning"}, {Name: "UsingShower"}}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.M5Stick{
+		{Mac: "00:00:00:00:00:01", RoleId: 1, LocationId: 1, SuccessMessage: "Thank you!"},
+		{Mac: "00:00:00:00:00:02", RoleId: 1, LocationId: 2},
+		{Mac: "00:00:00:00:00:03", RoleId: 2, LocationId: 1},
+	}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.User{{UID: "foo", Login: "kakiba"}, {UID: "bar", Login: "tanemura"}}).Error)
+	assert.NoError(t, db.Create(&accessdb.Shift{Date: time.Now().Format("2006-01-02"), UserID: 1}).Error)
+
+	tests := []struct {
+		uid        string
+		mac        string
+		session    string
+		todayCount int64
+		onShift    bool
+		message    string
+	}{
+		{uid: "foo", mac: "00:00:00:00:00:01", session: "opened", todayCount: 1, onShift: true, message: "Thank you!"},
+		// Taps on M5sticks of the same role count together, wherever they are.
+		{uid: "foo", mac: "00:00:00:00:00:02", session: "closed", todayCount: 2, onShift: true},
+		{uid: "foo", mac: "00:00:00:00:00:03", session: "opened", todayCount: 1, onShift: true},
+		{uid: "bar", mac: "00:00:00:00:00:01", session: "opened", todayCount: 1, onShift: false, message: "Thank you!"},
+		{uid: "foo", mac: "00:00:00:00:00:01", session: "opened", todayCount: 3, onShift: true, message: "Thank you!"},
+	}
+	for i, tt := range tests {
+		status, feedback, err := accessdb.AddActivityToDB(tt.uid, tt.mac)
+		assert.NoError(t, err, i)
+		assert.Equal(t, http.StatusOK, status, i)
+		assert.Equal(t, accessdb.TapFeedback{
+			Uid:        tt.uid,
+			Mac:        tt.mac,
+			Login:      map[string]string{"foo": "kakiba", "bar": "tanemura"}[tt.uid],
+			Message:    tt.message,
+			Session:    tt.session,
+			TodayCount: tt.todayCount,
+			OnShift:    tt.onShift,
+		}, *feedback, i)
+	}
+
+	status, _, err := accessdb.AddActivityToDB("foo", "99:99:99:99:99:99")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Error(t, err)
+}
+
+func TestRegistrationURLFollowsTrustedProxies(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.Location{Name: "F1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+	assert.NoError(t, db.Create(&accessdb.M5Stick{Mac: "00:00:00:00:00:01", RoleId: 1, LocationId: 1}).Error)
+	post := func() string {
+		router := gin.New()
+		assert.NoError(t, router.SetTrustedProxies(trustedProxies()))
+		router.POST("/activities", handlers.AddActivity)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/activities", strings.NewReader(`{"mac": "00:00:00:00:00:01", "uid": "foo"}`))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// The scheme a client claims is ignored.
+	t.Setenv("TRUSTED_PROXIES", "")
+	assert.Contains(t, post(), `"registration_url":"http://example.com/new?uid=foo"`)
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1, 192.0.2.0/24")
+	assert.Contains(t, post(), `"registration_url":"https://example.com/new?uid=foo"`)
+	t.Setenv("BASE_URL", "https://api.example.org/")
+	assert.Contains(t, post(), `"registration_url":"https://api.example.org/new?uid=foo"`)
+}
+
+func TestCreditPendingTaps(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.Location{Name: "F1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+	assert.NoError(t, db.Create(&accessdb.M5Stick{Mac: "00:00:00:00:00:01", RoleId: 1, LocationId: 1}).Error)
+	assert.NoError(t, db.Create(&accessdb.User{Login: "kakiba"}).Error)
+
+	router := gin.New()
+	router.POST("/activities", handlers.AddActivity)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/activities", strings.NewReader(`{"mac": "00:00:00:00:00:01", "uid": "foo"}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `"registration_url":"http://example.com/new?uid=foo"`)
+	assert.NotContains(t, w.Body.String(), `"qr"`)
+
+	pendingTaps, err := accessdb.GetPendingTapsFromDB()
+	assert.NoError(t, err)
+	assert.Len(t, pendingTaps, 1)
+	tappedAt := pendingTaps[0].CreatedAt
+
+	// Registering the card credits the tap at the time it was made, and only once.
+	assert.NoError(t, accessdb.AddUidToExistUser("kakiba", "foo", accessdb.Audit{Actor: "kakiba"}))
+	assert.NoError(t, accessdb.EditUserInDB("foo", "kakiba", "", accessdb.Audit{Actor: "staff"}))
+	var activities []accessdb.Activity
+	assert.NoError(t, db.Find(&activities).Error)
+	assert.Len(t, activities, 1)
+	assert.Equal(t, 1, activities[0].UserID)
+	assert.Equal(t, tappedAt, activities[0].CreatedAt)
+	pendingTaps, err = accessdb.GetPendingTapsFromDB()
+	assert.NoError(t, err)
+	assert.Empty(t, pendingTaps)
+
+	// The credited tap is published like a new one.
+	var outboxEvents []accessdb.OutboxEvent
+	assert.NoError(t, db.Where("type = ?", "activity.created").Find(&outboxEvents).Error)
+	assert.Len(t, outboxEvents, 1)
+	assert.JSONEq(t, fmt.Sprintf(`{"id":%d,"login":"kakiba","mac":"00:00:00:00:00:01","role":"Cleaning","location":"F1","session":"opened","created_at":%d}`, activities[0].ID, tappedAt), outboxEvents[0].Payload)
+}
+
+func TestRecordMQTTTap(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.Location{Name: "F1"}).Error)
+	assert.NoError(t, db.Create(&accessdb.Role{Name: "Cleaning"}).Error)
+	assert.NoError(t, db.Create(&accessdb.User{UID: "foo", Login: "kakiba"}).Error)
+	code, err := accessdb.AddEnrollmentCodeToDB("Cleaning", "F1", time.Now().Unix()+60)
+	assert.NoError(t, err)
+	_, _, token, err := accessdb.EnrollM5StickOnDB("00:00:00:00:00:01", code.Code)
+	assert.NoError(t, err)
+
+	status, err := recordMQTTTap("00:00:00:00:00:01", "foo", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Error(t, err)
+	status, err = recordMQTTTap("00:00:00:00:00:01", "foo", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Error(t, err)
+	var count int64
+	assert.NoError(t, db.Model(&accessdb.Activity{}).Count(&count).Error)
+	assert.Zero(t, count)
+
+	status, err = recordMQTTTap("00:00:00:00:00:01", "foo", token)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NoError(t, db.Model(&accessdb.Activity{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestStreamActivities(t *testing.T) {
+	router := gin.New()
+	router.GET("/activities/stream", handlers.StreamActivities)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	connect := func(lastEventID string) (*bufio.Reader, func()) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/activities/stream?role=Streaming", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		return bufio.NewReader(resp.Body), func() {
+			cancel()
+			resp.Body.Close()
+		}
+	}
+	// Reads the next event, skipping keep-alive comments, and returns its id and event lines.
+	next := func(reader *bufio.Reader) []string {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" && len(lines) > 0 {
+				return lines
+			}
+			if strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "event: ") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	publish := func(id int64, role string) {
+		events.Default.PublishEvent(events.Event{ID: id, Type: "activity.created", Data: accessdb.ActivityEvent{ID: uint(id), Role: role}})
+	}
+
+	reader, disconnect := connect("")
+	publish(9001, "Streaming")
+	publish(9002, "Other")
+	publish(9003, "Streaming")
+	assert.Equal(t, []string{"id: 9001", "event: activity.created"}, next(reader))
+	assert.Equal(t, []string{"id: 9003", "event: activity.created"}, next(reader))
+	disconnect()
+
+	// The events published while the client was away are sent on reconnect, and only those.
+	publish(9004, "Streaming")
+	reader, disconnect = connect("9003")
+	defer disconnect()
+	assert.Equal(t, []string{"id: 9004", "event: activity.created"}, next(reader))
+	publish(9005, "Streaming")
+	assert.Equal(t, []string{"id: 9005", "event: activity.created"}, next(reader))
+}
+
+func TestDashboardWebSocket(t *testing.T) {
+	t.Setenv("DASHBOARD_TOKEN", "secret")
+	router := gin.New()
+	router.GET("/dashboard/ws", handlers.DashboardWebSocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/dashboard/ws?topics=shift"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"&token=secret", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"dashboard", "wrong"}}
+	_, resp, err = dialer.Dial(url, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	headerConn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerConn.Close()
+
+	dialer.Subprotocols = []string{"dashboard", "secret"}
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal(t, "dashboard", resp.Header.Get("Sec-WebSocket-Protocol"))
+	var message handlers.WebSocketMessage
+	assert.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, []string{"shift"}, message.Topics)
+
+	events.Default.PublishEvent(events.Event{ID: 1, Type: "user.card_registered", Data: "skipped"})
+	events.Default.PublishEvent(events.Event{ID: 2, Type: "shift.exchanged", Data: "delivered"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.NoError(t, conn.ReadJSON(&message))
+	assert.Equal(t, "shift.exchanged", message.Type)
+	assert.Equal(t, "delivered", message.Data)
+}
+
+func TestWebhookURLMustBePublic(t *testing.T) {
+	ctx := context.Background()
+	for _, u := range []string{"http://127.0.0.1/hook", "http://localhost:8080/hook", "http://10.0.0.1/hook", "http://192.168.1.1/hook", "http://169.254.169.254/latest", "http://[::1]/hook", "http://0.0.0.0/hook"} {
+		assert.EqualError(t, webhook.CheckURL(ctx, u, false), "URL must not point to a private address", u)
+	}
+	assert.EqualError(t, webhook.CheckURL(ctx, "ftp://93.184.216.34/hook", false), "Invalid URL")
+	assert.NoError(t, webhook.CheckURL(ctx, "https://93.184.216.34/hook", false))
+	assert.NoError(t, webhook.CheckURL(ctx, "http://127.0.0.1/hook", true))
+
+	// A URL that passed the check but points to a private address when delivered is not connected to.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Webhook reached a private address")
+	}))
+	defer server.Close()
+	dispatcher := webhook.NewDispatcher(5*time.Second, 2, false)
+	delivery := accessdb.WebhookDelivery{ID: 1, EventType: "shift.deleted", Payload: `{"id":1}`, Status: "pending", Webhook: accessdb.Webhook{URL: server.URL, Secret: "secret"}}
+	dispatcher.Attempt(&delivery, time.Now())
+	assert.Equal(t, "pending", delivery.Status)
+	assert.Contains(t, delivery.Error, "Webhook must not connect to a private address")
+
+	router := gin.New()
+	router.POST("/webhooks", handlers.AddWebhook)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/webhooks", strings.NewReader(`{"url":"http://169.254.169.254/latest","events":["*"]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error":"URL must not point to a private address"}`, w.Body.String())
+}
+
+func TestWebhookAttempt(t *testing.T) {
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var timestamp int64
+		fmt.Sscan(r.Header.Get("X-Webhook-Timestamp"), &timestamp)
+		assert.Equal(t, webhook.Sign("secret", timestamp, body), r.Header.Get("X-Webhook-Signature"))
+		assert.Equal(t, "shift.deleted", r.Header.Get("X-Webhook-Event"))
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	dispatcher := webhook.NewDispatcher(5*time.Second, 2, true)
+	now := time.Unix(1712666900, 0)
+	delivery := accessdb.WebhookDelivery{ID: 1, EventType: "shift.deleted", Payload: `{"id":1}`, Status: "pending", Webhook: accessdb.Webhook{URL: server.URL, Secret: "secret"}}
+	dispatcher.Attempt(&delivery, now)
+	assert.Equal(t, "pending", delivery.Status)
+	assert.Equal(t, http.StatusBadGateway, delivery.ResponseCode)
+	assert.Equal(t, now.Add(30*time.Second).Unix(), delivery.NextAttemptAt)
+
+	fail = false
+	dispatcher.Attempt(&delivery, now)
+	assert.Equal(t, "succeeded", delivery.Status)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Equal(t, 2*time.Minute, webhook.Backoff(3))
+}
+
+func TestClaimDueWebhookDeliveries(t *testing.T) {
+	db := useTestDB(t)
+	assert.NoError(t, db.Create(&accessdb.Webhook{URL: "https://example.com/hook", Events: "*", Secret: "secret"}).Error)
+	assert.NoError(t, db.Create(&[]accessdb.WebhookDelivery{
+		{WebhookID: 1, EventID: 1, Status: "pending", NextAttemptAt: 100},
+		{WebhookID: 1, EventID: 2, Status: "pending", NextAttemptAt: 300},
+		{WebhookID: 1, EventID: 3, Status: "succeeded", NextAttemptAt: 100},
+	}).Error)
+
+	deliveries, err := accessdb.ClaimDueWebhookDeliveriesOnDB(200, 500, 10)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, int64(1), deliveries[0].EventID)
+	assert.Equal(t, "https://example.com/hook", deliveries[0].Webhook.URL)
+
+	// A claimed delivery is not due again until the claim runs out.
+	deliveries, err = accessdb.ClaimDueWebhookDeliveriesOnDB(400, 800, 10)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, int64(2), deliveries[0].EventID)
+	deliveries, err = accessdb.ClaimDueWebhookDeliveriesOnDB(500, 900, 10)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, int64(1), deliveries[0].EventID)
+}
+
+func TestAuditDiff(t *testing.T) {
+	diff, err := accessdb.AuditDiff([]byte(`{"ID":1,"UID":"","Wallet":"0xa"}`), []byte(`{"ID":1,"UID":"abc","Wallet":"0xa"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"UID":{"before":"","after":"abc"}}`, string(diff))
+
+	diff, err = accessdb.AuditDiff(nil, []byte(`{"ID":1}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"ID":{"before":null,"after":1}}`, string(diff))
+}
+
+func TestAuditRequestID(t *testing.T) {
+	router := gin.New()
+	router.Use(handlers.AuditRequests())
+	router.GET("/ping", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/ping", nil)
+	req.Header.Set("X-Request-ID", "request-1")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "request-1", w.Header().Get("X-Request-ID"))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/ping", nil)
+	router.ServeHTTP(w, req)
+	assert.Len(t, w.Header().Get("X-Request-ID"), 32)
+}
+
+func TestAuditActorAndClientIP(t *testing.T) {
+	db := useTestDB(t)
+	post := func() {
+		router := gin.New()
+		assert.NoError(t, router.SetTrustedProxies(trustedProxies()))
+		router.Use(handlers.AuditRequests())
+		router.POST("/ping", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodPost, "/ping", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Actor", "staff1")
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Neither the actor nor the address can be claimed by the client.
+	t.Setenv("TRUSTED_PROXIES", "")
+	post()
+	var entry accessdb.AuditLog
+	assert.NoError(t, db.Last(&entry).Error)
+	assert.Equal(t, "", entry.Actor)
+	assert.Equal(t, "192.0.2.1", entry.IP)
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.0/24")
+	post()
+	var forwarded accessdb.AuditLog
+	assert.NoError(t, db.Last(&forwarded).Error)
+	assert.Equal(t, "198.51.100.7", forwarded.IP)
+}
+
+func TestAuditLogLimit(t *testing.T) {
+	useTestDB(t)
+	router := gin.New()
+	router.GET("/audit", handlers.GetAuditLogs)
+
+	for limit, status := range map[string]int{"1000": http.StatusOK, "1001": http.StatusBadRequest, "0": http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit?limit="+limit, nil))
+		assert.Equal(t, status, w.Code, limit)
+	}
+}
+
 func TestLoadConfig(t *testing.T) {
 	config, _ := loadconfig.LoadConfig()
 	assert.Equal(t, os.Getenv("UID"), config.UID)
@@ -136,7 +1944,7 @@ func testConnectToDB() (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.AutoMigrate(&accessdb.Shift{}, &accessdb.User{}, &accessdb.M5Stick{}, &accessdb.Activity{}, &accessdb.Location{}, &accessdb.Role{})
+	db.AutoMigrate(&accessdb.Shift{}, &accessdb.Slot{}, &accessdb.User{}, &accessdb.WalletChallenge{}, &accessdb.M5Stick{}, &accessdb.EnrollmentCode{}, &accessdb.Firmware{}, &accessdb.Activity{}, &accessdb.PendingTap{}, &accessdb.Location{}, &accessdb.Role{}, &accessdb.PointRule{}, &accessdb.PointEntry{}, &accessdb.PayoutBatch{}, &accessdb.PayoutItem{}, &accessdb.OutboxEvent{}, &accessdb.Webhook{}, &accessdb.WebhookDelivery{}, &accessdb.ReminderLog{}, &accessdb.EscalationLog{}, &accessdb.MissedShift{}, &accessdb.AuditLog{})
 	return db, nil
 }
 
@@ -1,7 +1,10 @@
 package accessdb
 
 import (
+	"errors"
+	"github.com/jinzhu/now"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"net/http"
 	"time"
 )
@@ -28,35 +31,186 @@ func GetActivitiesFromDB(start_time int64, end_time int64, role string) ([]Activ
 	return activities, nil
 }
 
-// Receive the uid and MAC address, and add a new activity.
-func AddActivityToDB(uid string, mac string) (int, string, string, error) {
+/*
+Receive the uid and MAC address, add a new activity, and return the feedback for the M5stick.
+Taps of a user on M5sticks of the same role alternately open and close a session within a day.
+The message is the one configured for the M5stick, or empty if there is none.
+The feedback is counted in the transaction that adds the activity, so it always includes the tap, and if it cannot be counted the tap is not added either.
+The new activity is written to the outbox in the same transaction. If the card is not registered, the tap is kept as pending, and 404 is returned with the feedback.
+*/
+func AddActivityToDB(uid string, mac string) (int, *TapFeedback, error) {
 	db, err := ConnectToDB()
 	if err != nil {
-		return http.StatusInternalServerError, "", "", err
+		return http.StatusInternalServerError, nil, err
 	}
 
-	var user User
-	if err := db.Where("uid = ?", uid).First(&user).Error; err != nil {
+	var m5Stick M5Stick
+	if err := db.Preload("Role").Preload("Location").Where("mac = ?", mac).First(&m5Stick).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return http.StatusNotFound, "", "", err
+			return http.StatusNotFound, nil, err
 		} else {
-			return http.StatusInternalServerError, "", "", err
+			return http.StatusInternalServerError, nil, err
 		}
 	}
 
-	var m5Stick M5Stick
-	if err := db.Where("mac = ?", mac).First(&m5Stick).Error; err != nil {
+	var user User
+	if err := db.Where("uid = ?", uid).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return http.StatusNotFound, "", "", err
+			pendingTap := PendingTap{UID: uid, M5StickID: m5Stick.ID, CreatedAt: time.Now().Unix()}
+			if result := db.Create(&pendingTap); result.Error != nil {
+				return http.StatusInternalServerError, nil, result.Error
+			}
+			return http.StatusNotFound, &TapFeedback{Uid: uid, Mac: mac, Message: m5Stick.ErrorMessage}, errors.New("Card is not registered")
 		} else {
-			return http.StatusInternalServerError, "", "", err
+			return http.StatusInternalServerError, nil, err
 		}
 	}
 
 	activity := Activity{UserID: user.ID, M5StickID: m5Stick.ID, CreatedAt: time.Now().Unix()}
 
-	if result := db.Create(&activity); result.Error != nil {
-		return http.StatusBadRequest, "", "", result.Error
+	status := http.StatusOK
+	var feedback *TapFeedback
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&activity).Error; err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		var err error
+		if feedback, err = getTapFeedback(tx, user, m5Stick); err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		err = addOutboxEvent(tx, "activity.created", ActivityEvent{
+			ID:        activity.ID,
+			Login:     user.Login,
+			Mac:       m5Stick.Mac,
+			Role:      m5Stick.Role.Name,
+			Location:  m5Stick.Location.Name,
+			Session:   feedback.Session,
+			CreatedAt: activity.CreatedAt,
+		})
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		return err
+	})
+	if err != nil {
+		return status, nil, err
+	}
+	notifyOutbox()
+	feedback.Uid = uid
+	return status, feedback, nil
+}
+
+// Returns the feedback of a tap that has just been added for the user on the M5stick.
+func getTapFeedback(db *gorm.DB, user User, m5Stick M5Stick) (*TapFeedback, error) {
+	beginningOfDay := now.BeginningOfDay()
+
+	var todayCount int64
+	err := db.Model(&Activity{}).
+		Joins("INNER JOIN m5_sticks ON activities.m5_stick_id = m5_sticks.id").
+		Where("activities.user_id = ? AND m5_sticks.role_id = ? AND activities.created_at >= ?", user.ID, m5Stick.RoleId, beginningOfDay.Unix()).
+		Count(&todayCount).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var shiftCount int64
+	if err := db.Model(&Shift{}).Where("user_id = ? AND date = ?", user.ID, beginningOfDay.Format("2006-01-02")).Count(&shiftCount).Error; err != nil {
+		return nil, err
+	}
+
+	session := "closed"
+	if todayCount%2 == 1 {
+		session = "opened"
+	}
+	return &TapFeedback{
+		Mac:        m5Stick.Mac,
+		Login:      user.Login,
+		Message:    m5Stick.SuccessMessage,
+		Session:    session,
+		TodayCount: todayCount,
+		OnShift:    shiftCount > 0,
+	}, nil
+}
+
+// Returns the taps of cards that are not registered yet.
+func GetPendingTapsFromDB() ([]PendingTap, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var pendingTaps []PendingTap
+	err = db.Preload("M5Stick").Preload("M5Stick.Role").Preload("M5Stick.Location").
+		Where("activity_id IS NULL").
+		Order("created_at").
+		Find(&pendingTaps).Error
+	if err != nil {
+		return nil, err
+	}
+	return pendingTaps, nil
+}
+
+/*
+Credits the pending taps of the user's card as activities at the time they were tapped.
+Called in the transaction that writes the user, and the taps are locked so that they are credited only once.
+Each credited activity is written to the outbox like a new tap.
+*/
+func creditPendingTaps(tx *gorm.DB, user User) error {
+	if user.UID == "" {
+		return nil
+	}
+	var pendingTaps []PendingTap
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Preload("M5Stick.Role").Preload("M5Stick.Location").
+		Where("uid = ? AND activity_id IS NULL", user.UID).
+		Order("created_at, id").
+		Find(&pendingTaps).Error
+	if err != nil {
+		return err
+	}
+	for _, p := range pendingTaps {
+		activity := Activity{UserID: user.ID, M5StickID: p.M5StickID, CreatedAt: p.CreatedAt}
+		if err := tx.Create(&activity).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&p).Update("activity_id", activity.ID).Error; err != nil {
+			return err
+		}
+		session, err := creditedTapSession(tx, user, p.M5Stick, activity)
+		if err != nil {
+			return err
+		}
+		err = addOutboxEvent(tx, "activity.created", ActivityEvent{
+			ID:        activity.ID,
+			Login:     user.Login,
+			Mac:       p.M5Stick.Mac,
+			Role:      p.M5Stick.Role.Name,
+			Location:  p.M5Stick.Location.Name,
+			Session:   session,
+			CreatedAt: activity.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns whether the credited activity opened or closed a session, counting the taps on the role that day up to it.
+func creditedTapSession(tx *gorm.DB, user User, m5Stick M5Stick, activity Activity) (string, error) {
+	beginningOfDay := now.With(time.Unix(activity.CreatedAt, 0)).BeginningOfDay()
+	var count int64
+	err := tx.Model(&Activity{}).
+		Joins("INNER JOIN m5_sticks ON activities.m5_stick_id = m5_sticks.id").
+		Where("activities.user_id = ? AND m5_sticks.role_id = ? AND activities.created_at >= ?", user.ID, m5Stick.RoleId, beginningOfDay.Unix()).
+		Where("activities.created_at < ? OR (activities.created_at = ? AND activities.id <= ?)", activity.CreatedAt, activity.CreatedAt, activity.ID).
+		Count(&count).Error
+	if err != nil {
+		return "", err
+	}
+	if count%2 == 1 {
+		return "opened", nil
 	}
-	return http.StatusOK, uid, mac, nil
+	return "closed", nil
 }
@@ -0,0 +1,132 @@
+package accessdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"gorm.io/gorm"
+	"time"
+)
+
+/*
+Writes the change of the entity to the audit log in the transaction of the change.
+before is nil for a created entity, and the fields that differ are stored as the diff.
+*/
+func addAuditLog(tx *gorm.DB, audit Audit, action string, entityType string, entityID string, before interface{}, after interface{}) error {
+	var beforeJSON, afterJSON []byte
+	var err error
+	if before != nil {
+		if beforeJSON, err = json.Marshal(before); err != nil {
+			return err
+		}
+	}
+	if afterJSON, err = json.Marshal(after); err != nil {
+		return err
+	}
+	diff, err := AuditDiff(beforeJSON, afterJSON)
+	if err != nil {
+		return err
+	}
+	entry := AuditLog{
+		RequestID:  audit.RequestID,
+		Actor:      audit.Actor,
+		IP:         audit.IP,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Before:     string(beforeJSON),
+		After:      string(afterJSON),
+		Diff:       string(diff),
+		CreatedAt:  time.Now().Unix(),
+	}
+	return tx.Create(&entry).Error
+}
+
+/*
+Receives an entity as JSON objects before and after a change, either of which may be empty, and returns
+the top-level fields that differ as {"field": {"before": ..., "after": ...}}. A missing field is null.
+*/
+func AuditDiff(before []byte, after []byte) ([]byte, error) {
+	beforeFields := make(map[string]json.RawMessage)
+	afterFields := make(map[string]json.RawMessage)
+	if len(before) > 0 {
+		if err := json.Unmarshal(before, &beforeFields); err != nil {
+			return nil, err
+		}
+	}
+	if len(after) > 0 {
+		if err := json.Unmarshal(after, &afterFields); err != nil {
+			return nil, err
+		}
+	}
+
+	type change struct {
+		Before json.RawMessage `json:"before"`
+		After  json.RawMessage `json:"after"`
+	}
+	null := json.RawMessage("null")
+	diff := make(map[string]change)
+	for _, fields := range []map[string]json.RawMessage{beforeFields, afterFields} {
+		for field := range fields {
+			if _, ok := diff[field]; ok {
+				continue
+			}
+			b, ok := beforeFields[field]
+			if !ok {
+				b = null
+			}
+			a, ok := afterFields[field]
+			if !ok {
+				a = null
+			}
+			if !bytes.Equal(b, a) {
+				diff[field] = change{Before: b, After: a}
+			}
+		}
+	}
+	return json.Marshal(diff)
+}
+
+// Receives who made a mutating request, the method and route as the action, the path, and the status, and records the request.
+func AddRequestAuditLogToDB(audit Audit, action string, path string, status int) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	entry := AuditLog{
+		RequestID:  audit.RequestID,
+		Actor:      audit.Actor,
+		IP:         audit.IP,
+		Action:     action,
+		EntityType: "request",
+		EntityID:   path,
+		Status:     status,
+		CreatedAt:  time.Now().Unix(),
+	}
+	return db.Create(&entry).Error
+}
+
+/*
+Receives the entity type and ID and the request ID to narrow the entries by, each of which may be empty,
+the start and end of the time range in unix time, and a limit, and returns the entries, newest first.
+*/
+func GetAuditLogsFromDB(entityType string, entityID string, requestID string, start int64, end int64, limit int) ([]AuditLog, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	query := db.Where("created_at >= ? AND created_at < ?", start, end)
+	if entityType != "" {
+		query = query.Where("entity_type = ?", entityType)
+	}
+	if entityID != "" {
+		query = query.Where("entity_id = ?", entityID)
+	}
+	if requestID != "" {
+		query = query.Where("request_id = ?", requestID)
+	}
+	var entries []AuditLog
+	if err := query.Order("id DESC").Limit(limit).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
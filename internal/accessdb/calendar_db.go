@@ -0,0 +1,77 @@
+package accessdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+/*
+Receives the login and returns the secret token of the user's calendar feed.
+If the user has no token yet, or reset is true, a new token is issued.
+*/
+func GetCalendarTokenFromDB(login string, reset bool) (string, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return "", err
+	}
+
+	var user User
+	if err := db.Where("login = ?", login).First(&user).Error; err != nil {
+		return "", err
+	}
+	if user.CalendarToken != "" && !reset {
+		return user.CalendarToken, nil
+	}
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	if err := db.Model(&user).Update("calendar_token", token).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Receives the calendar token and returns the user who owns it.
+func GetUserByCalendarTokenFromDB(token string) (*User, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	if err := db.Where("calendar_token = ? AND calendar_token <> ''", token).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+/*
+Receives the user ID (nil for everyone) and the first date, and returns the shifts from that date.
+Deleted shifts are included so that calendars can show them as cancelled.
+*/
+func GetCalendarShiftsFromDB(userId *int, from string) ([]Shift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var shifts []Shift
+	query := db.Unscoped().Preload("User").Preload("Slot.Location").Preload("Slot.Role").Where("date >= ?", from)
+	if userId != nil {
+		query = query.Where("user_id = ?", *userId)
+	}
+	if err := query.Order("date").Order("id").Find(&shifts).Error; err != nil {
+		return nil, err
+	}
+	return shifts, nil
+}
+
+// Returns a random hex string that can be used as a secret.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
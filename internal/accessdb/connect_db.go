@@ -6,21 +6,60 @@ import (
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"os"
+	"sync"
 )
 
 type Shift struct {
-	ID     uint `gorm:"primaryKey"`
-	Date   string
-	UserID int  `json: "user_id"`
-	User   User `gorm:"foreignKey:UserID"`
-	DeletedAt gorm.DeletedAt
+	ID           uint `gorm:"primaryKey"`
+	Date         string
+	UserID       int  `json: "user_id"`
+	User         User `gorm:"foreignKey:UserID"`
+	SlotID       *uint
+	Slot         *Slot `gorm:"foreignKey:SlotID"`
+	DeletedAt    gorm.DeletedAt
+	DeletedBy    string `gorm:"default:''"`
+	DeleteReason string `gorm:"default:''"`
+	RestoredBy   string `gorm:"default:''"`
+	RestoredAt   int64  `gorm:"default:0"`
+	Revision     int    `gorm:"default:0"`
+}
+
+/*
+A time slot of a shift. Capacity 0 means the slot has no limit.
+Open slots can be claimed by students themselves.
+*/
+type Slot struct {
+	ID         uint `gorm:"primaryKey"`
+	Date       string
+	StartTime  string `gorm:"default:''"`
+	EndTime    string `gorm:"default:''"`
+	LocationId *int
+	Location   *Location `gorm:"foreignKey:LocationId"`
+	RoleId     *int
+	Role       *Role `gorm:"foreignKey:RoleId"`
+	Capacity   int
+	Open       bool
+	Taken      int64 `gorm:"-:all"`
 }
 
 type User struct {
-	ID     int
-	UID    string `gorm:"default:''"`
-	Login  string
-	Wallet string `gorm:"size:42;default:''"`
+	ID             int
+	UID            string `gorm:"default:''"`
+	Login          string
+	Wallet         string `gorm:"size:42;default:''"`
+	WalletVerified bool   `gorm:"default:false"`
+	LeaderboardOff bool   `gorm:"default:false"`
+	CalendarToken  string `gorm:"size:64;default:''" json:"-"`
+}
+
+// A nonce the user signs with the wallet to prove owning it.
+type WalletChallenge struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    int    `gorm:"uniqueIndex"`
+	User      User   `gorm:"foreignKey:UserID"`
+	Wallet    string `gorm:"size:42"`
+	Nonce     string `gorm:"size:64"`
+	ExpiresAt int64
 }
 
 type Activity struct {
@@ -32,13 +71,48 @@ type Activity struct {
 	CreatedAt int64   `json: "created_at"`
 }
 
+// A tap of a card that is not registered yet. It is credited as an activity once the card is registered.
+type PendingTap struct {
+	ID         uint   `gorm:"primaryKey"`
+	UID        string `gorm:"index"`
+	M5StickID  int
+	M5Stick    M5Stick `gorm:"foreignKey:M5StickID"`
+	CreatedAt  int64
+	ActivityID *uint
+}
+
 type M5Stick struct {
-	ID         int
-	Mac        string
+	ID              int
+	Mac             string
+	RoleId          int
+	Role            Role `gorm:"foreignKey:RoleId"`
+	LocationId      int
+	Location        Location `gorm:"foreignKey:LocationId"`
+	LastSeen        int64    `gorm:"default:0"`
+	FirmwareVersion string   `gorm:"default:''"`
+	Battery         *int
+	Rssi            int    `gorm:"default:0"`
+	Uptime          int64  `gorm:"default:0"`
+	IdleMessage     string `gorm:"default:''"`
+	SuccessMessage  string `gorm:"default:''"`
+	ErrorMessage    string `gorm:"default:''"`
+	TapCooldown     int    `gorm:"default:0"`
+	ConfigVersion   int    `gorm:"default:1"`
+	TokenHash       string `gorm:"size:64;default:''" json:"-"`
+	FirmwareID      *uint
+}
+
+// A one-time code with which an unregistered M5stick registers itself with the role and location.
+type EnrollmentCode struct {
+	ID         uint   `gorm:"primaryKey"`
+	Code       string `gorm:"size:16;uniqueIndex"`
 	RoleId     int
 	Role       Role `gorm:"foreignKey:RoleId"`
 	LocationId int
 	Location   Location `gorm:"foreignKey:LocationId"`
+	ExpiresAt  int64
+	UsedAt     int64 `gorm:"default:0"`
+	M5StickID  *int
 }
 
 type Location struct {
@@ -47,8 +121,285 @@ type Location struct {
 }
 
 type Role struct {
-	ID   int
-	Name string
+	ID         int
+	Name       string
+	FirmwareID *uint
+}
+
+// A firmware release of the M5sticks. The binary is stored on the local disk at Path.
+type Firmware struct {
+	ID        uint   `gorm:"primaryKey"`
+	Version   string `gorm:"size:32;uniqueIndex"`
+	Channel   string `gorm:"default:'stable'"`
+	Checksum  string `gorm:"size:64"`
+	Size      int64
+	Path      string `json:"-"`
+	CreatedAt int64
+}
+
+// What a M5stick shows after a tap.
+type TapFeedback struct {
+	Uid        string `json:"uid"`
+	Mac        string `json:"mac"`
+	Login      string `json:"login"`
+	Message    string `json:"message"`
+	Session    string `json:"session"`
+	TodayCount int64  `json:"today_count"`
+	OnShift    bool   `json:"on_shift"`
+}
+
+type Heartbeat struct {
+	FirmwareVersion string `json:"firmware_version"`
+	Battery         *int   `json:"battery"`
+	Rssi            int    `json:"rssi"`
+	Uptime          int64  `json:"uptime"`
+}
+
+type DisplayMessages struct {
+	Idle    string `json:"idle"`
+	Success string `json:"success"`
+	Error   string `json:"error"`
+}
+
+// The behavior of a M5stick, delivered to the device. Empty values fall back to the defaults.
+type DeviceConfig struct {
+	Version     int             `json:"version"`
+	Mac         string          `json:"mac"`
+	Role        string          `json:"role"`
+	Location    string          `json:"location"`
+	Messages    DisplayMessages `json:"messages"`
+	TapCooldown int             `json:"tap_cooldown"`
+}
+
+// Points given for the sessions and shifts of a role.
+type PointRule struct {
+	ID               uint `gorm:"primaryKey"`
+	RoleId           int  `gorm:"uniqueIndex"`
+	Role             Role `gorm:"foreignKey:RoleId"`
+	PointsPerSession int
+	PointsPerHour    int
+	PointsPerShift   int
+}
+
+/*
+An entry of the points ledger. Entries are only appended, and a correction is another entry.
+Kind and SourceID identify what the points were given for, so that they are not given twice.
+*/
+type PointEntry struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    int  `gorm:"index"`
+	User      User `gorm:"foreignKey:UserID"`
+	Points    int
+	Kind      string `gorm:"size:16;uniqueIndex:idx_point_entries_source"`
+	SourceID  *uint  `gorm:"uniqueIndex:idx_point_entries_source"`
+	Reason    string
+	CreatedBy string `gorm:"default:''"`
+	CreatedAt int64  `gorm:"index"`
+	// The payout batch that pays the entry, nil while it is unpaid
+	PayoutBatchID *uint `gorm:"index"`
+}
+
+/*
+A batch of token payouts for the points earned in a period. A draft can be recalculated or deleted,
+and the batch is locked once approved, then marked as paid with the hash of the transaction.
+*/
+type PayoutBatch struct {
+	ID         uint   `gorm:"primaryKey"`
+	StartDate  string `gorm:"size:10"`
+	EndDate    string `gorm:"size:10"`
+	Status     string `gorm:"size:16;default:'draft'"`
+	CreatedBy  string `gorm:"default:''"`
+	ApprovedBy string `gorm:"default:''"`
+	TxHash     string `gorm:"size:66;default:''"`
+	CreatedAt  int64
+	ApprovedAt int64        `gorm:"default:0"`
+	PaidAt     int64        `gorm:"default:0"`
+	Items      []PayoutItem `gorm:"foreignKey:BatchID"`
+}
+
+// The payout to a user in a batch. A user without a verified wallet is flagged and left out of the export.
+type PayoutItem struct {
+	ID      uint `gorm:"primaryKey"`
+	BatchID uint `gorm:"index"`
+	UserID  int
+	User    User   `gorm:"foreignKey:UserID"`
+	Wallet  string `gorm:"size:42"`
+	Points  int64
+	Amount  int64
+	Flag    string `gorm:"size:32;default:''"`
+}
+
+/*
+A shift the user did not attend, found by comparing the shifts with the taps once the day is over.
+Misses counts the outstanding misses of the user in the period up to this one, and the miss is escalated to staff
+when it reaches the threshold. A miss is outstanding until staff resolve it.
+*/
+type MissedShift struct {
+	ID                uint   `gorm:"primaryKey"`
+	ShiftID           uint   `gorm:"uniqueIndex"`
+	UserID            int    `gorm:"index"`
+	User              User   `gorm:"foreignKey:UserID"`
+	Date              string `gorm:"size:10"`
+	Misses            int
+	Escalated         bool `gorm:"default:false"`
+	Penalty           int  `gorm:"default:0"`
+	DetectedAt        int64
+	StudentNotifiedAt int64  `gorm:"default:0"`
+	StaffNotifiedAt   int64  `gorm:"default:0"`
+	ResolvedAt        int64  `gorm:"default:0;index"`
+	ResolvedBy        string `gorm:"default:''"`
+	ResolveNote       string `gorm:"default:''"`
+}
+
+/*
+A reminder of a shift sent to the user through a channel at an offset before the shift, kept so that it is not sent twice.
+The user is part of it, so that the user a shift was exchanged to is reminded as well.
+*/
+type ReminderLog struct {
+	ID            uint   `gorm:"primaryKey"`
+	ShiftID       uint   `gorm:"uniqueIndex:idx_reminder_logs_sent"`
+	UserID        int    `gorm:"uniqueIndex:idx_reminder_logs_sent"`
+	OffsetSeconds int64  `gorm:"uniqueIndex:idx_reminder_logs_sent"`
+	Channel       string `gorm:"size:16;uniqueIndex:idx_reminder_logs_sent"`
+	SentAt        int64
+}
+
+/*
+A notification of a missed shift sent to the recipient, the student or a staff member, through a channel,
+kept so that a channel that accepted it is not sent it again when another channel failed.
+*/
+type EscalationLog struct {
+	ID            uint   `gorm:"primaryKey"`
+	MissedShiftID uint   `gorm:"uniqueIndex:idx_escalation_logs_sent"`
+	Recipient     string `gorm:"size:64;uniqueIndex:idx_escalation_logs_sent"`
+	Channel       string `gorm:"size:16;uniqueIndex:idx_escalation_logs_sent"`
+	SentAt        int64
+}
+
+/*
+An event written in the same transaction as the change it describes. The relay publishes it and marks it as dispatched,
+so an event is delivered at least once even if the API stops right after the change. The ID is the ID of the event.
+*/
+type OutboxEvent struct {
+	ID           uint   `gorm:"primaryKey"`
+	Type         string `gorm:"size:64"`
+	Payload      string `gorm:"type:text"`
+	CreatedAt    int64
+	DispatchedAt int64 `gorm:"default:0;index"`
+}
+
+/*
+A subscription of an external service to events of the API. Events is a comma-separated list of event types,
+and "*" subscribes to every event. The payloads are signed with the secret.
+*/
+type Webhook struct {
+	ID        uint `gorm:"primaryKey"`
+	URL       string
+	Events    string
+	Secret    string `gorm:"size:64" json:"-"`
+	CreatedBy string `gorm:"default:''"`
+	CreatedAt int64
+	DeletedAt gorm.DeletedAt
+}
+
+// A delivery of an event to a webhook. A failed attempt is retried with backoff until the attempts run out.
+type WebhookDelivery struct {
+	ID            uint    `gorm:"primaryKey"`
+	WebhookID     uint    `gorm:"uniqueIndex:idx_webhook_deliveries_event"`
+	Webhook       Webhook `gorm:"foreignKey:WebhookID" json:"-"`
+	EventID       int64   `gorm:"uniqueIndex:idx_webhook_deliveries_event"`
+	EventType     string  `gorm:"size:64"`
+	Payload       string  `gorm:"type:text"`
+	Status        string  `gorm:"size:16;default:'pending';index:idx_webhook_deliveries_due"`
+	Attempts      int     `gorm:"default:0"`
+	ResponseCode  int     `gorm:"default:0"`
+	Error         string  `gorm:"type:text"`
+	NextAttemptAt int64   `gorm:"index:idx_webhook_deliveries_due"`
+	CreatedAt     int64
+	DeliveredAt   int64 `gorm:"default:0"`
+}
+
+/*
+An entry of the audit log, which is only ever appended to. A change to a user or shift is recorded in the same
+transaction as the change, with the entity as JSON before and after it and the fields that differ.
+A mutating request is recorded as well, with its status, and the request ID ties it to the changes it made.
+*/
+type AuditLog struct {
+	ID         uint   `gorm:"primaryKey"`
+	RequestID  string `gorm:"size:64;index"`
+	Actor      string `gorm:"default:''"`
+	IP         string `gorm:"size:45;default:''"`
+	Action     string `gorm:"size:64"`
+	EntityType string `gorm:"size:32;index:idx_audit_logs_entity"`
+	EntityID   string `gorm:"size:64;index:idx_audit_logs_entity"`
+	Before     string `gorm:"type:text"`
+	After      string `gorm:"type:text"`
+	Diff       string `gorm:"type:text"`
+	Status     int    `gorm:"default:0"`
+	CreatedAt  int64  `gorm:"index"`
+}
+
+// Who made a change, from which address, and in which request, as recorded in the audit log.
+type Audit struct {
+	RequestID string
+	Actor     string
+	IP        string
+}
+
+// An activity as published to the event bus.
+type ActivityEvent struct {
+	ID        uint   `json:"id"`
+	Login     string `json:"login"`
+	Mac       string `json:"mac"`
+	Role      string `json:"role"`
+	Location  string `json:"location"`
+	Session   string `json:"session"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// A card registered to a user, as published to the event bus.
+type CardEvent struct {
+	Login string `json:"login"`
+	Uid   string `json:"uid"`
+}
+
+// How missed shifts are escalated. A threshold or penalty of 0 turns that step off.
+type MissRule struct {
+	PenaltyPoints  int
+	StaffThreshold int
+	PeriodDays     int
+}
+
+// A missed shift as published to the event bus.
+type MissedShiftEvent struct {
+	ID        uint   `json:"id"`
+	Login     string `json:"login"`
+	Date      string `json:"date"`
+	Misses    int    `json:"misses"`
+	Escalated bool   `json:"escalated"`
+	Penalty   int    `json:"penalty"`
+}
+
+type LeaderboardEntry struct {
+	Rank  int    `json:"rank"`
+	Login string `json:"login"`
+	Value int64  `json:"value"`
+}
+
+type ActivityStat struct {
+	Group string `json:"group"`
+	Count int64  `json:"count"`
+	Users int64  `json:"users"`
+}
+
+type PayoutRecipient struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+type Balance struct {
+	Login   string `json:"login"`
+	Balance int64  `json:"balance"`
 }
 
 type Date struct {
@@ -56,8 +407,13 @@ type Date struct {
 }
 
 type Schedule struct {
-	Date  string   `json:"date"`
-	Login []string `json:"login"`
+	Date      string   `json:"date"`
+	Login     []string `json:"login"`
+	StartTime string   `json:"start_time"`
+	EndTime   string   `json:"end_time"`
+	Location  string   `json:"location"`
+	Role      string   `json:"role"`
+	Capacity  int      `json:"capacity"`
 }
 
 type UserRequestData struct {
@@ -70,7 +426,22 @@ type Users struct {
 	Users []UserRequestData `json:"users"`
 }
 
+var (
+	sharedDB   *gorm.DB
+	sharedDBMu sync.Mutex
+)
+
+/*
+Returns the connection pool to the DB, opening it and migrating the tables on the first call.
+The pool is shared, so background workers calling this periodically do not open new connections each time.
+*/
 func ConnectToDB() (*gorm.DB, error) {
+	sharedDBMu.Lock()
+	defer sharedDBMu.Unlock()
+	if sharedDB != nil {
+		return sharedDB, nil
+	}
+
 	dsn, err := getDSN()
 	if err != nil {
 		return nil, err
@@ -79,10 +450,38 @@ func ConnectToDB() (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.AutoMigrate(&Shift{}, &User{}, &M5Stick{}, &Activity{}, &Location{}, &Role{})
+	db.AutoMigrate(&Shift{}, &Slot{}, &User{}, &WalletChallenge{}, &M5Stick{}, &EnrollmentCode{}, &Firmware{}, &Activity{}, &PendingTap{}, &Location{}, &Role{}, &PointRule{}, &PointEntry{}, &PayoutBatch{}, &PayoutItem{}, &OutboxEvent{}, &Webhook{}, &WebhookDelivery{}, &ReminderLog{}, &EscalationLog{}, &MissedShift{}, &AuditLog{})
+	// The battery used to default to 0, so clear it for the M5sticks that have never reported it.
+	db.Model(&M5Stick{}).Where("last_seen = 0 AND battery = 0").Update("battery", nil)
+	sharedDB = db
 	return db, nil
 }
 
+/*
+Closes the connection pool after the queries in progress finish. Called when the API shuts down,
+after which ConnectToDB opens a new pool.
+*/
+func CloseDB() error {
+	sharedDBMu.Lock()
+	defer sharedDBMu.Unlock()
+	if sharedDB == nil {
+		return nil
+	}
+	sqlDB, err := sharedDB.DB()
+	if err != nil {
+		return err
+	}
+	sharedDB = nil
+	return sqlDB.Close()
+}
+
+// Replaces the shared connection pool with the given DB, which lets tests run against SQLite. nil resets it.
+func UseDB(db *gorm.DB) {
+	sharedDBMu.Lock()
+	defer sharedDBMu.Unlock()
+	sharedDB = db
+}
+
 func getDSN() (string, error) {
 	dsn := os.Getenv("DSN")
 	if dsn == "" {
@@ -0,0 +1,140 @@
+package accessdb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"time"
+)
+
+// Characters of enrollment codes, without the ones that are easily confused such as 0 and O.
+const enrollmentCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Receives the role name, location name and expiry, and issues a new enrollment code.
+func AddEnrollmentCodeToDB(roleName string, locationName string, expiresAt int64) (*EnrollmentCode, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var role Role
+	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return nil, err
+	}
+	var location Location
+	if err := db.Where("name = ?", locationName).First(&location).Error; err != nil {
+		return nil, err
+	}
+	code, err := generateEnrollmentCode()
+	if err != nil {
+		return nil, err
+	}
+
+	enrollmentCode := EnrollmentCode{Code: code, RoleId: role.ID, Role: role, LocationId: location.ID, Location: location, ExpiresAt: expiresAt}
+	if result := db.Omit("Role", "Location").Create(&enrollmentCode); result.Error != nil {
+		return nil, result.Error
+	}
+	return &enrollmentCode, nil
+}
+
+/*
+Receives the MAC address and enrollment code, registers the M5stick with the role and location of the code,
+and returns the M5stick with the token it authenticates with. The code can be used only once.
+*/
+func EnrollM5StickOnDB(mac string, code string) (int, *M5Stick, string, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, "", err
+	}
+
+	status := http.StatusOK
+	var m5Stick M5Stick
+	token, err := generateToken()
+	if err != nil {
+		return http.StatusInternalServerError, nil, "", err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var enrollmentCode EnrollmentCode
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code).First(&enrollmentCode).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				status = http.StatusNotFound
+				return errors.New("Enrollment code not found")
+			}
+			return err
+		}
+		if enrollmentCode.UsedAt != 0 || enrollmentCode.ExpiresAt < time.Now().Unix() {
+			status = http.StatusGone
+			return errors.New("Enrollment code is used or expired")
+		}
+		if err := tx.Where("mac = ?", mac).First(&M5Stick{}).Error; err == nil {
+			status = http.StatusConflict
+			return errors.New("M5Stick already exists")
+		} else if err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		m5Stick = M5Stick{Mac: mac, RoleId: enrollmentCode.RoleId, LocationId: enrollmentCode.LocationId, TokenHash: hashToken(token)}
+		if err := tx.Create(&m5Stick).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&enrollmentCode).Updates(map[string]interface{}{"used_at": time.Now().Unix(), "m5_stick_id": m5Stick.ID}).Error; err != nil {
+			return err
+		}
+		return tx.Preload("Role").Preload("Location").Where("id = ?", m5Stick.ID).First(&m5Stick).Error
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return status, nil, "", err
+	}
+	return status, &m5Stick, token, nil
+}
+
+/*
+Receives the MAC address and the token the request carries, and checks that the M5stick may use it.
+M5sticks registered without enrollment have no token and are always accepted.
+*/
+func VerifyM5StickToken(mac string, token string) (int, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	var m5Stick M5Stick
+	if err := db.Where("mac = ?", mac).First(&m5Stick).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return http.StatusNotFound, errors.New("M5Stick not found")
+		}
+		return http.StatusInternalServerError, err
+	}
+	if m5Stick.TokenHash == "" {
+		return http.StatusOK, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(m5Stick.TokenHash), []byte(hashToken(token))) != 1 {
+		return http.StatusUnauthorized, errors.New("Invalid M5Stick token")
+	}
+	return http.StatusOK, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateEnrollmentCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = enrollmentCodeChars[int(b[i])%len(enrollmentCodeChars)]
+	}
+	return string(b), nil
+}
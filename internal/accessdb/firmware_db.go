@@ -0,0 +1,147 @@
+package accessdb
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Receives a firmware release, and if the same version does not exist in the DB, adds it.
+func AddFirmwareToDB(firmware Firmware) (*Firmware, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var existingFirmware Firmware
+	if err := db.Where("version = ?", firmware.Version).First(&existingFirmware).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("Firmware already exists")
+	}
+	firmware.CreatedAt = time.Now().Unix()
+
+	if result := db.Create(&firmware); result.Error != nil {
+		return nil, result.Error
+	}
+	return &firmware, nil
+}
+
+// Receives the firmware ID and deletes the firmware release.
+func DeleteFirmwareFromDB(id uint) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	return db.Where("id = ?", id).Delete(&Firmware{}).Error
+}
+
+// Receives the channel (empty for all channels) and returns the firmware releases, newest first.
+func GetFirmwaresFromDB(channel string) ([]Firmware, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var firmwares []Firmware
+	query := db.Order("created_at DESC").Order("id DESC")
+	if channel != "" {
+		query = query.Where("channel = ?", channel)
+	}
+	if err := query.Find(&firmwares).Error; err != nil {
+		return nil, err
+	}
+	return firmwares, nil
+}
+
+// Receives the firmware ID and returns the firmware release.
+func GetFirmwareFromDB(id uint) (*Firmware, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var firmware Firmware
+	if err := db.Where("id = ?", id).First(&firmware).Error; err != nil {
+		return nil, err
+	}
+	return &firmware, nil
+}
+
+// Receives the MAC address and version, and makes it the target firmware of the M5stick. An empty version clears it.
+func SetM5StickFirmwareOnDB(mac string, version string) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+
+	var m5Stick M5Stick
+	if err := db.Where("mac = ?", mac).First(&m5Stick).Error; err != nil {
+		return err
+	}
+	firmwareId, err := getFirmwareIdFromVersion(db, version)
+	if err != nil {
+		return err
+	}
+	return db.Model(&m5Stick).Update("firmware_id", firmwareId).Error
+}
+
+// Receives the role name and version, and makes it the target firmware of the role. An empty version clears it.
+func SetRoleFirmwareOnDB(roleName string, version string) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+
+	var role Role
+	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return err
+	}
+	firmwareId, err := getFirmwareIdFromVersion(db, version)
+	if err != nil {
+		return err
+	}
+	return db.Model(&role).Update("firmware_id", firmwareId).Error
+}
+
+/*
+Receives the MAC address and returns the M5stick with the firmware it should run.
+The target of the M5stick itself takes precedence over the target of its role.
+The firmware is nil if neither has a target.
+*/
+func GetTargetFirmwareFromDB(mac string) (*M5Stick, *Firmware, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var m5Stick M5Stick
+	if err := db.Preload("Role").Where("mac = ?", mac).First(&m5Stick).Error; err != nil {
+		return nil, nil, err
+	}
+	firmwareId := m5Stick.FirmwareID
+	if firmwareId == nil {
+		firmwareId = m5Stick.Role.FirmwareID
+	}
+	if firmwareId == nil {
+		return &m5Stick, nil, nil
+	}
+	var firmware Firmware
+	if err := db.Where("id = ?", *firmwareId).First(&firmware).Error; err != nil {
+		return nil, nil, err
+	}
+	return &m5Stick, &firmware, nil
+}
+
+func getFirmwareIdFromVersion(db *gorm.DB, version string) (*uint, error) {
+	if version == "" {
+		return nil, nil
+	}
+	var firmware Firmware
+	if err := db.Where("version = ?", version).First(&firmware).Error; err != nil {
+		return nil, err
+	}
+	return &firmware.ID, nil
+}
@@ -0,0 +1,110 @@
+package accessdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+Receives the role, time range, and metric, and ranks the users by their taps ("count")
+or by the seconds of their closed sessions ("duration") on M5sticks of the role, aggregated in SQL.
+An empty role ranks over all roles. Users who opted out are left out.
+Users with the same value share the rank and are ordered by login.
+*/
+func GetLeaderboardFromDB(role string, startTime int64, endTime int64, metric string) ([]LeaderboardEntry, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.Model(&Activity{}).
+		Joins("INNER JOIN users ON activities.user_id = users.id").
+		Joins("INNER JOIN m5_sticks ON activities.m5_stick_id = m5_sticks.id").
+		Where("activities.created_at >= ? AND activities.created_at < ?", startTime, endTime).
+		Where("users.leaderboard_off = ?", false)
+	if role != "" {
+		query = query.Joins("INNER JOIN roles ON m5_sticks.role_id = roles.id").Where("roles.name = ?", role)
+	}
+
+	type value struct {
+		Login string
+		Value int64
+	}
+	var rows []value
+	if metric == "duration" {
+		/*
+			Like PairSessions, the taps of a user on a role in a day are paired in order, and a tap left
+			without a pair is an open session. The day follows the offset the local zone has at the time of each tap.
+		*/
+		offset := LocalOffsetSQL("activities.created_at", time.Unix(startTime, 0), time.Unix(endTime, 0))
+		day := fmt.Sprintf("activities.created_at + %s - (activities.created_at + %s) %% 86400", offset, offset)
+		numbered := query.Select("users.login AS login, activities.created_at AS created_at, " +
+			"ROW_NUMBER() OVER (PARTITION BY activities.user_id, m5_sticks.role_id, " + day + " ORDER BY activities.created_at, activities.id) AS n, " +
+			"COUNT(*) OVER (PARTITION BY activities.user_id, m5_sticks.role_id, " + day + ") AS total")
+		err = db.Table("(?) AS taps", numbered).
+			Select("login, SUM(CASE WHEN n % 2 = 0 THEN created_at WHEN n < total THEN -created_at ELSE 0 END) AS value").
+			Group("login").
+			Having("SUM(CASE WHEN n % 2 = 0 THEN 1 ELSE 0 END) > 0").
+			Scan(&rows).Error
+	} else {
+		err = query.Select("users.login AS login, COUNT(*) AS value").Group("users.login").Scan(&rows).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		values[r.Login] = r.Value
+	}
+	return RankLeaderboard(values), nil
+}
+
+// Receives the name, and returns the role.
+func GetRoleFromDB(name string) (*Role, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var role Role
+	if err := db.Where("name = ?", name).First(&role).Error; err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// Receives the value of each login, and returns them ranked from the highest, ties ordered by login.
+func RankLeaderboard(values map[string]int64) []LeaderboardEntry {
+	entries := make([]LeaderboardEntry, 0, len(values))
+	for login, value := range values {
+		entries = append(entries, LeaderboardEntry{Login: login, Value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].Login < entries[j].Login
+	})
+	for i := range entries {
+		if i > 0 && entries[i].Value == entries[i-1].Value {
+			entries[i].Rank = entries[i-1].Rank
+		} else {
+			entries[i].Rank = i + 1
+		}
+	}
+	return entries
+}
+
+// Receives the login, and sets whether the user is left out of the leaderboards.
+func SetLeaderboardOptOutOnDB(login string, optOut bool) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	var user User
+	if err := db.Where("login = ?", login).First(&user).Error; err != nil {
+		return err
+	}
+	return db.Model(&user).Update("leaderboard_off", optOut).Error
+}
@@ -3,6 +3,7 @@ package accessdb
 import (
 	"errors"
 	"gorm.io/gorm"
+	"time"
 )
 
 /*
@@ -41,3 +42,96 @@ func AddM5StickToDB(mac string, roleName string, locationName string) error {
 	}
 	return nil
 }
+
+// Receives the MAC address and a heartbeat, and records it as the latest state of the M5stick.
+func RecordHeartbeatOnDB(mac string, heartbeat Heartbeat) (*M5Stick, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var m5Stick M5Stick
+	if err := db.Where("mac = ?", mac).First(&m5Stick).Error; err != nil {
+		return nil, err
+	}
+	result := db.Model(&m5Stick).Updates(map[string]interface{}{
+		"last_seen":        time.Now().Unix(),
+		"firmware_version": heartbeat.FirmwareVersion,
+		"battery":          heartbeat.Battery,
+		"rssi":             heartbeat.Rssi,
+		"uptime":           heartbeat.Uptime,
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &m5Stick, nil
+}
+
+/*
+Receives the time before which a M5stick counts as offline, the battery level at or below which it counts as low,
+and a location name (empty for all locations), and returns the M5sticks that are offline or low on battery.
+A M5stick that has not reported its battery does not count as low.
+*/
+func GetUnhealthyM5SticksFromDB(offlineBefore int64, lowBattery int, location string) ([]M5Stick, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var m5Sticks []M5Stick
+	query := db.Preload("Role").Preload("Location").
+		Where("m5_sticks.last_seen < ? OR (m5_sticks.battery IS NOT NULL AND m5_sticks.battery <= ?)", offlineBefore, lowBattery)
+	if location != "" {
+		query = query.Joins("INNER JOIN locations ON m5_sticks.location_id = locations.id").Where("locations.name = ?", location)
+	}
+	if err := query.Order("m5_sticks.location_id").Order("m5_sticks.mac").Find(&m5Sticks).Error; err != nil {
+		return nil, err
+	}
+	return m5Sticks, nil
+}
+
+// Receives the MAC address and returns the configuration of the M5stick.
+func GetM5StickConfigFromDB(mac string) (*DeviceConfig, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var m5Stick M5Stick
+	if err := db.Preload("Role").Preload("Location").Where("mac = ?", mac).First(&m5Stick).Error; err != nil {
+		return nil, err
+	}
+	return &DeviceConfig{
+		Version:  m5Stick.ConfigVersion,
+		Mac:      m5Stick.Mac,
+		Role:     m5Stick.Role.Name,
+		Location: m5Stick.Location.Name,
+		Messages: DisplayMessages{
+			Idle:    m5Stick.IdleMessage,
+			Success: m5Stick.SuccessMessage,
+			Error:   m5Stick.ErrorMessage,
+		},
+		TapCooldown: m5Stick.TapCooldown,
+	}, nil
+}
+
+// Receives the MAC address, display messages and tap cooldown, updates the M5stick, and bumps its config version.
+func UpdateM5StickConfigOnDB(mac string, messages DisplayMessages, tapCooldown int) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+
+	var m5Stick M5Stick
+	if err := db.Where("mac = ?", mac).First(&m5Stick).Error; err != nil {
+		return err
+	}
+	result := db.Model(&m5Stick).Updates(map[string]interface{}{
+		"idle_message":    messages.Idle,
+		"success_message": messages.Success,
+		"error_message":   messages.Error,
+		"tap_cooldown":    tapCooldown,
+		"config_version":  gorm.Expr("config_version + 1"),
+	})
+	return result.Error
+}
@@ -0,0 +1,245 @@
+package accessdb
+
+import (
+	"database/sql"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"time"
+)
+
+// Receives shifts and the activities with their M5stick on the same days, and returns the shifts nobody attended.
+func FindMissedShifts(shifts []Shift, activities []Activity) []Shift {
+	var missed []Shift
+	for _, s := range shifts {
+		if _, ok := findAttendance(s, activities); !ok {
+			missed = append(missed, s)
+		}
+	}
+	return missed
+}
+
+/*
+Receives the first and last dates, which have to be over, and the rule, and records the shifts in the range
+that were not attended and not recorded yet. For each miss, the penalty is appended to the points ledger,
+the outstanding misses of the user in the period are counted, and the miss is written to the outbox.
+Returns the new misses.
+*/
+func DetectMissedShiftsOnDB(start string, end string, rule MissRule) ([]MissedShift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	startTime, err := time.ParseInLocation("2006-01-02", start, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	endTime, err := time.ParseInLocation("2006-01-02", end, time.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	var activities []Activity
+	err = db.Preload("M5Stick").
+		Where("created_at >= ? AND created_at < ?", startTime.Unix(), endTime.AddDate(0, 0, 1).Unix()).
+		Order("created_at").Order("id").
+		Find(&activities).Error
+	if err != nil {
+		return nil, err
+	}
+	var shifts []Shift
+	err = db.Preload("User").Preload("Slot").
+		Where("date >= ? AND date <= ?", start, end).
+		Where("id NOT IN (?)", db.Model(&MissedShift{}).Select("shift_id")).
+		Order("date").Order("id").
+		Find(&shifts).Error
+	if err != nil {
+		return nil, err
+	}
+	missedShifts := FindMissedShifts(shifts, activities)
+	if len(missedShifts) == 0 {
+		return nil, nil
+	}
+
+	var missed []MissedShift
+	now := time.Now().Unix()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, s := range missedShifts {
+			m := MissedShift{ShiftID: s.ID, UserID: s.UserID, Date: s.Date, DetectedAt: now}
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&m)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				// Recorded by another check in the meantime.
+				continue
+			}
+			m.User = s.User
+			if rule.PenaltyPoints > 0 {
+				sourceId := s.ID
+				entry := PointEntry{UserID: s.UserID, Points: -rule.PenaltyPoints, Kind: "penalty", SourceID: &sourceId, Reason: "Missed shift on " + s.Date, CreatedAt: now}
+				if err := tx.Create(&entry).Error; err != nil {
+					return err
+				}
+				m.Penalty = rule.PenaltyPoints
+			}
+			periodStart := time.Time{}
+			if rule.PeriodDays > 0 {
+				date, err := time.ParseInLocation("2006-01-02", s.Date, time.Local)
+				if err != nil {
+					return err
+				}
+				periodStart = date.AddDate(0, 0, 1-rule.PeriodDays)
+			}
+			var misses int64
+			err := tx.Model(&MissedShift{}).
+				Where("user_id = ? AND resolved_at = ? AND date >= ? AND date <= ?", s.UserID, 0, periodStart.Format("2006-01-02"), s.Date).
+				Count(&misses).Error
+			if err != nil {
+				return err
+			}
+			m.Misses = int(misses)
+			m.Escalated = rule.StaffThreshold > 0 && m.Misses >= rule.StaffThreshold
+			if err := tx.Model(&m).Select("Misses", "Escalated", "Penalty").Updates(&m).Error; err != nil {
+				return err
+			}
+			event := MissedShiftEvent{ID: m.ID, Login: s.User.Login, Date: m.Date, Misses: m.Misses, Escalated: m.Escalated, Penalty: m.Penalty}
+			if err := addOutboxEvent(tx, "shift.missed", event); err != nil {
+				return err
+			}
+			missed = append(missed, m)
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, err
+	}
+	notifyOutbox()
+	return missed, nil
+}
+
+// Returns the outstanding misses of which the student, or staff if escalated, has not been notified yet.
+func GetUnnotifiedMissedShiftsFromDB() ([]MissedShift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var missed []MissedShift
+	err = db.Preload("User").
+		Where("resolved_at = ?", 0).
+		Where("student_notified_at = ? OR (escalated = ? AND staff_notified_at = ?)", 0, true, 0).
+		Order("id").
+		Find(&missed).Error
+	if err != nil {
+		return nil, err
+	}
+	return missed, nil
+}
+
+// Receives the ID of a miss, who was notified (student or staff), and the time, and records the notification.
+func MarkMissedShiftNotifiedOnDB(id uint, recipient string, notifiedAt int64) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	column := "student_notified_at"
+	if recipient == "staff" {
+		column = "staff_notified_at"
+	}
+	return db.Model(&MissedShift{}).Where("id = ?", id).Update(column, notifiedAt).Error
+}
+
+// Receives the IDs of misses, and returns the notifications sent for them.
+func GetEscalationLogsFromDB(missedIds []uint) ([]EscalationLog, error) {
+	if len(missedIds) == 0 {
+		return nil, nil
+	}
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var logs []EscalationLog
+	if err := db.Where("missed_shift_id IN ?", missedIds).Find(&logs).Error; err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// Records that the notification was sent. Recording it again does nothing.
+func AddEscalationLogToDB(escalationLog EscalationLog) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&escalationLog).Error
+}
+
+// Receives a login to narrow them by, and returns the outstanding misses, oldest first.
+func GetOutstandingMissedShiftsFromDB(login string) ([]MissedShift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	query := db.Preload("User").Where("resolved_at = ?", 0)
+	if login != "" {
+		userId, err := getUserIdFromLogin(db, login)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("user_id = ?", userId)
+	}
+	var missed []MissedShift
+	if err := query.Order("date").Order("id").Find(&missed).Error; err != nil {
+		return nil, err
+	}
+	return missed, nil
+}
+
+/*
+Receives the ID of a miss, who resolved it, a note, and whether to refund the penalty, and resolves the miss.
+The refund is appended to the points ledger, so the penalty itself stays on record.
+*/
+func ResolveMissedShiftOnDB(id uint, resolvedBy string, note string, refund bool) (int, *MissedShift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	status := http.StatusOK
+	var missed MissedShift
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("User").Where("id = ?", id).First(&missed).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				status = http.StatusNotFound
+			} else {
+				status = http.StatusInternalServerError
+			}
+			return err
+		}
+		if missed.ResolvedAt != 0 {
+			status = http.StatusConflict
+			return errors.New("Missed shift is already resolved")
+		}
+		missed.ResolvedAt = time.Now().Unix()
+		missed.ResolvedBy = resolvedBy
+		missed.ResolveNote = note
+		if err := tx.Model(&missed).Select("ResolvedAt", "ResolvedBy", "ResolveNote").Updates(&missed).Error; err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		if refund && missed.Penalty > 0 {
+			sourceId := missed.ShiftID
+			entry := PointEntry{UserID: missed.UserID, Points: missed.Penalty, Kind: "penalty_refund", SourceID: &sourceId, Reason: "Refund for the missed shift on " + missed.Date, CreatedBy: resolvedBy, CreatedAt: missed.ResolvedAt}
+			if err := tx.Create(&entry).Error; err != nil {
+				status = http.StatusInternalServerError
+				return err
+			}
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return status, nil, err
+	}
+	return status, &missed, nil
+}
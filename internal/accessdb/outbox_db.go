@@ -0,0 +1,122 @@
+package accessdb
+
+import (
+	"encoding/json"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// Signals the relay that events were committed, so that it does not wait for its next poll.
+var outboxNotify = make(chan struct{}, 1)
+
+// Returns the channel that receives a value when events were written to the outbox.
+func OutboxNotifications() <-chan struct{} {
+	return outboxNotify
+}
+
+func notifyOutbox() {
+	select {
+	case outboxNotify <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Writes the event to the outbox in the transaction of the change it describes.
+The caller notifies the relay after the transaction is committed.
+*/
+func addOutboxEvent(tx *gorm.DB, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&OutboxEvent{Type: eventType, Payload: string(payload), CreatedAt: time.Now().Unix()}).Error
+}
+
+// Receives an event that is not part of a change to the DB, such as a M5stick going offline, and writes it to the outbox.
+func AddOutboxEventToDB(eventType string, data interface{}) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	if err := addOutboxEvent(db, eventType, data); err != nil {
+		return err
+	}
+	notifyOutbox()
+	return nil
+}
+
+/*
+Receives a limit, the time, and a function relaying events, and passes it the events that are not dispatched yet,
+oldest first. The events are locked with SKIP LOCKED, so that the relays of other instances skip them instead of
+relaying them twice, and the IDs the function returns are marked as dispatched in the same transaction.
+Returns the number of events marked as dispatched.
+*/
+func RelayPendingOutboxEventsOnDB(limit int, dispatchedAt int64, relay func(outboxEvents []OutboxEvent) []uint) (int, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var outboxEvents []OutboxEvent
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("dispatched_at = ?", 0).Order("id").Limit(limit).Find(&outboxEvents).Error
+		if err != nil {
+			return err
+		}
+		ids := relay(outboxEvents)
+		count = len(ids)
+		if count == 0 {
+			return nil
+		}
+		return tx.Model(&OutboxEvent{}).Where("id IN ?", ids).Update("dispatched_at", dispatchedAt).Error
+	})
+	return count, err
+}
+
+// Returns the ID of the latest event written to the outbox, or 0 if there is none.
+func GetLastOutboxEventIDFromDB() (uint, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return 0, err
+	}
+	var id uint
+	if err := db.Model(&OutboxEvent{}).Select("COALESCE(MAX(id), 0)").Scan(&id).Error; err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+/*
+Receives an ID, the IDs of earlier events that were not committed yet when they were last read, and a limit,
+and returns those of the earlier events that are committed now and the events after the ID, in the order of their IDs.
+Every instance reads the outbox this way, whether or not the events are dispatched.
+*/
+func GetOutboxEventsAfterFromDB(afterID uint, missingIDs []uint, limit int) ([]OutboxEvent, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	query := db.Where("id > ?", afterID)
+	if len(missingIDs) > 0 {
+		query = db.Where("id > ? OR id IN ?", afterID, missingIDs)
+	}
+	var outboxEvents []OutboxEvent
+	if err := query.Order("id").Limit(limit).Find(&outboxEvents).Error; err != nil {
+		return nil, err
+	}
+	return outboxEvents, nil
+}
+
+// Receives a time, and deletes the events dispatched before it. Returns the number of deleted events.
+func DeleteDispatchedOutboxEventsFromDB(before int64) (int64, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return 0, err
+	}
+	result := db.Where("dispatched_at > ? AND dispatched_at < ?", 0, before).Delete(&OutboxEvent{})
+	return result.RowsAffected, result.Error
+}
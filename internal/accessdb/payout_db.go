@@ -0,0 +1,266 @@
+package accessdb
+
+import (
+	"database/sql"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"time"
+)
+
+/*
+Receives the last date of the period, the tokens paid per point, and who made it,
+and adds a draft payout batch for the points not yet paid by the end of the period.
+The period starts the day after the last batch ends, or at the first unpaid point entry for the first batch,
+and each point entry is linked to the batch that pays it.
+*/
+func AddPayoutBatchToDB(end string, tokensPerPoint int64, createdBy string) (int, *PayoutBatch, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	status := http.StatusOK
+	batch := PayoutBatch{EndDate: end, Status: "draft", CreatedBy: createdBy, CreatedAt: time.Now().Unix()}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		start, err := payoutBatchStart(tx, end)
+		if err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		if start > end {
+			status = http.StatusConflict
+			return errors.New("End date must be after the last payout batch")
+		}
+		batch.StartDate = start
+		if err := tx.Create(&batch).Error; err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		if err := calculatePayoutItems(tx, &batch, tokensPerPoint); err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return status, nil, err
+	}
+	return status, &batch, nil
+}
+
+// Receives the last date of a new batch, and returns the first date of its period.
+func payoutBatchStart(tx *gorm.DB, end string) (string, error) {
+	var last PayoutBatch
+	err := tx.Order("end_date DESC").First(&last).Error
+	if err == nil {
+		lastEnd, err := time.ParseInLocation("2006-01-02", last.EndDate, time.Local)
+		if err != nil {
+			return "", err
+		}
+		return lastEnd.AddDate(0, 0, 1).Format("2006-01-02"), nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return "", err
+	}
+	var first PointEntry
+	err = tx.Where("payout_batch_id IS NULL").Order("created_at").First(&first).Error
+	if err == gorm.ErrRecordNotFound {
+		return end, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if start := time.Unix(first.CreatedAt, 0).Format("2006-01-02"); start < end {
+		return start, nil
+	}
+	return end, nil
+}
+
+// Returns the payout batches without their items, newest first.
+func GetPayoutBatchesFromDB() ([]PayoutBatch, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var batches []PayoutBatch
+	if err := db.Order("end_date DESC").Find(&batches).Error; err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// Receives the ID, and returns the payout batch with its items.
+func GetPayoutBatchFromDB(id uint) (*PayoutBatch, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var batch PayoutBatch
+	if err := db.Preload("Items", func(db *gorm.DB) *gorm.DB { return db.Order("amount DESC") }).Preload("Items.User").Where("id = ?", id).First(&batch).Error; err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// Receives the ID and the tokens paid per point, and calculates the items of the draft batch again.
+func RecalculatePayoutBatchOnDB(id uint, tokensPerPoint int64) (int, *PayoutBatch, error) {
+	return changePayoutBatch(id, "draft", func(tx *gorm.DB, batch *PayoutBatch) error {
+		return calculatePayoutItems(tx, batch, tokensPerPoint)
+	})
+}
+
+// Receives the ID and who approved it, and locks the draft batch.
+func ApprovePayoutBatchOnDB(id uint, approvedBy string) (int, *PayoutBatch, error) {
+	return changePayoutBatch(id, "draft", func(tx *gorm.DB, batch *PayoutBatch) error {
+		batch.Status, batch.ApprovedBy, batch.ApprovedAt = "approved", approvedBy, time.Now().Unix()
+		return tx.Model(batch).Select("status", "approved_by", "approved_at").Updates(batch).Error
+	})
+}
+
+// Receives the ID and the hash of the transaction that paid it, and marks the approved batch as paid.
+func MarkPayoutBatchPaidOnDB(id uint, txHash string) (int, *PayoutBatch, error) {
+	return changePayoutBatch(id, "approved", func(tx *gorm.DB, batch *PayoutBatch) error {
+		batch.Status, batch.TxHash, batch.PaidAt = "paid", txHash, time.Now().Unix()
+		return tx.Model(batch).Select("status", "tx_hash", "paid_at").Updates(batch).Error
+	})
+}
+
+// Receives the ID, and deletes the draft batch with its items, leaving its point entries unpaid.
+func DeletePayoutBatchFromDB(id uint) (int, error) {
+	status, _, err := changePayoutBatch(id, "draft", func(tx *gorm.DB, batch *PayoutBatch) error {
+		if err := tx.Model(&PointEntry{}).Where("payout_batch_id = ?", batch.ID).Update("payout_batch_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("batch_id = ?", batch.ID).Delete(&PayoutItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(batch).Error
+	})
+	return status, err
+}
+
+/*
+Locks the batch row, checks that the batch has the status, and applies the change.
+Returns the batch as it is after the change.
+*/
+func changePayoutBatch(id uint, from string, change func(tx *gorm.DB, batch *PayoutBatch) error) (int, *PayoutBatch, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	status := http.StatusOK
+	var batch PayoutBatch
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&batch).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				status = http.StatusNotFound
+			} else {
+				status = http.StatusInternalServerError
+			}
+			return err
+		}
+		if batch.Status != from {
+			status = http.StatusConflict
+			if batch.Status == "draft" {
+				return errors.New("Payout batch is not approved")
+			}
+			return errors.New("Payout batch is locked")
+		}
+		if err := change(tx, &batch); err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return status, nil, err
+	}
+	return status, &batch, nil
+}
+
+/*
+Replaces the items of the batch with the balance of the point entries each user has not been paid
+by the end of its period, including late entries and the ones left out of earlier batches.
+Users whose unpaid points add up to nothing are left out. The entries of unflagged items are linked
+to the batch, while flagged ones stay unpaid so that a later batch pays them.
+*/
+func calculatePayoutItems(tx *gorm.DB, batch *PayoutBatch, tokensPerPoint int64) error {
+	endTime, err := time.ParseInLocation("2006-01-02", batch.EndDate, time.Local)
+	if err != nil {
+		return err
+	}
+
+	type earning struct {
+		UserID         int
+		Wallet         string
+		WalletVerified bool
+		Points         int64
+	}
+	if err := tx.Model(&PointEntry{}).Where("payout_batch_id = ?", batch.ID).Update("payout_batch_id", nil).Error; err != nil {
+		return err
+	}
+	before := endTime.AddDate(0, 0, 1).Unix()
+	var earnings []earning
+	err = tx.Model(&PointEntry{}).
+		Select("users.id AS user_id, users.wallet AS wallet, users.wallet_verified AS wallet_verified, SUM(point_entries.points) AS points").
+		Joins("INNER JOIN users ON point_entries.user_id = users.id").
+		Where("point_entries.payout_batch_id IS NULL AND point_entries.created_at < ?", before).
+		Group("users.id, users.wallet, users.wallet_verified").
+		Scan(&earnings).Error
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Where("batch_id = ?", batch.ID).Delete(&PayoutItem{}).Error; err != nil {
+		return err
+	}
+	batch.Items = nil
+	for _, e := range earnings {
+		if e.Points <= 0 {
+			continue
+		}
+		item := PayoutItem{BatchID: batch.ID, UserID: e.UserID, Wallet: e.Wallet, Points: e.Points, Amount: e.Points * tokensPerPoint}
+		if e.Wallet == "" {
+			item.Flag = "missing_wallet"
+		} else if !e.WalletVerified {
+			item.Flag = "unverified_wallet"
+		}
+		if err := tx.Create(&item).Error; err != nil {
+			return err
+		}
+		if item.Flag == "" {
+			err := tx.Model(&PointEntry{}).
+				Where("user_id = ? AND payout_batch_id IS NULL AND created_at < ?", e.UserID, before).
+				Update("payout_batch_id", batch.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+		batch.Items = append(batch.Items, item)
+	}
+	return nil
+}
+
+/*
+Receives the items of a batch, and returns the amount paid to each wallet in the order they first appear.
+Flagged items are left out, and items of users sharing a wallet are added up.
+*/
+func PayoutRecipients(items []PayoutItem) []PayoutRecipient {
+	var recipients []PayoutRecipient
+	index := make(map[string]int)
+	for _, item := range items {
+		if item.Flag != "" {
+			continue
+		}
+		if i, ok := index[item.Wallet]; ok {
+			recipients[i].Amount += item.Amount
+			continue
+		}
+		index[item.Wallet] = len(recipients)
+		recipients = append(recipients, PayoutRecipient{Address: item.Wallet, Amount: item.Amount})
+	}
+	return recipients
+}
@@ -0,0 +1,269 @@
+package accessdb
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"sort"
+	"time"
+)
+
+// A pair of taps of a user on M5sticks of the same role in a day.
+type Session struct {
+	UserID int
+	RoleId int
+	Open   Activity
+	Close  Activity
+}
+
+// Returns the length of the session in seconds.
+func (s Session) Duration() int64 {
+	return s.Close.CreatedAt - s.Open.CreatedAt
+}
+
+/*
+Receives activities with their M5stick, and pairs them into sessions.
+Taps of a user on M5sticks of the same role alternately open and close a session within a day,
+and a session that is still open is left out.
+*/
+func PairSessions(activities []Activity) []Session {
+	sorted := make([]Activity, len(activities))
+	copy(sorted, activities)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].CreatedAt != sorted[j].CreatedAt {
+			return sorted[i].CreatedAt < sorted[j].CreatedAt
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	type sessionKey struct {
+		userId int
+		roleId int
+		date   string
+	}
+	opened := make(map[sessionKey]Activity)
+	var sessions []Session
+	for _, a := range sorted {
+		key := sessionKey{a.UserID, a.M5Stick.RoleId, time.Unix(a.CreatedAt, 0).Format("2006-01-02")}
+		if open, ok := opened[key]; ok {
+			sessions = append(sessions, Session{UserID: a.UserID, RoleId: key.roleId, Open: open, Close: a})
+			delete(opened, key)
+		} else {
+			opened[key] = a
+		}
+	}
+	return sessions
+}
+
+// Returns the point rules of all roles.
+func GetPointRulesFromDB() ([]PointRule, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var rules []PointRule
+	if err := db.Preload("Role").Order("role_id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Receives the role name and points, and adds or replaces the point rule of the role.
+func SetPointRuleOnDB(roleName string, perSession int, perHour int, perShift int) (*PointRule, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var role Role
+	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return nil, err
+	}
+	var rule PointRule
+	if err := db.Where("role_id = ?", role.ID).First(&rule).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	rule.RoleId = role.ID
+	rule.PointsPerSession = perSession
+	rule.PointsPerHour = perHour
+	rule.PointsPerShift = perShift
+	if err := db.Save(&rule).Error; err != nil {
+		return nil, err
+	}
+	rule.Role = role
+	return &rule, nil
+}
+
+/*
+Receives the first and last dates, and appends ledger entries for the sessions closed
+and the shifts attended on those days. A shift counts as attended if the user tapped that day,
+on a M5stick of the slot's role if it has one. Points already given are not given again.
+Returns the number of entries added.
+*/
+func AccruePointsOnDB(start string, end string) (int, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return 0, err
+	}
+	startTime, err := time.ParseInLocation("2006-01-02", start, time.Local)
+	if err != nil {
+		return 0, err
+	}
+	endTime, err := time.ParseInLocation("2006-01-02", end, time.Local)
+	if err != nil {
+		return 0, err
+	}
+
+	var rules []PointRule
+	if err := db.Find(&rules).Error; err != nil {
+		return 0, err
+	}
+	ruleOfRole := make(map[int]PointRule)
+	for _, r := range rules {
+		ruleOfRole[r.RoleId] = r
+	}
+
+	var activities []Activity
+	err = db.Preload("M5Stick").
+		Where("created_at >= ? AND created_at < ?", startTime.Unix(), endTime.AddDate(0, 0, 1).Unix()).
+		Order("created_at").Order("id").
+		Find(&activities).Error
+	if err != nil {
+		return 0, err
+	}
+	var shifts []Shift
+	if err := db.Preload("Slot").Where("date >= ? AND date <= ?", start, end).Find(&shifts).Error; err != nil {
+		return 0, err
+	}
+
+	var entries []PointEntry
+	for _, s := range PairSessions(activities) {
+		rule := ruleOfRole[s.RoleId]
+		points := rule.PointsPerSession + int(int64(rule.PointsPerHour)*s.Duration()/3600)
+		if points == 0 {
+			continue
+		}
+		sourceId := s.Open.ID
+		entries = append(entries, PointEntry{
+			UserID:    s.UserID,
+			Points:    points,
+			Kind:      "session",
+			SourceID:  &sourceId,
+			Reason:    fmt.Sprintf("Session of %d minutes", s.Duration()/60),
+			CreatedAt: s.Close.CreatedAt,
+		})
+	}
+	for _, s := range shifts {
+		attendance, ok := findAttendance(s, activities)
+		if !ok {
+			continue
+		}
+		points := ruleOfRole[attendance.M5Stick.RoleId].PointsPerShift
+		if points == 0 {
+			continue
+		}
+		sourceId := s.ID
+		entries = append(entries, PointEntry{
+			UserID:    s.UserID,
+			Points:    points,
+			Kind:      "shift",
+			SourceID:  &sourceId,
+			Reason:    "Shift on " + s.Date,
+			CreatedAt: attendance.CreatedAt,
+		})
+	}
+
+	added := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, e := range entries {
+			var count int64
+			if err := tx.Model(&PointEntry{}).Where("kind = ? AND source_id = ?", e.Kind, *e.SourceID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			if err := tx.Create(&e).Error; err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// Returns the first activity that shows the user attended the shift.
+func findAttendance(shift Shift, activities []Activity) (Activity, bool) {
+	for _, a := range activities {
+		if a.UserID != shift.UserID || time.Unix(a.CreatedAt, 0).Format("2006-01-02") != shift.Date {
+			continue
+		}
+		if shift.Slot != nil && shift.Slot.RoleId != nil && *shift.Slot.RoleId != a.M5Stick.RoleId {
+			continue
+		}
+		return a, true
+	}
+	return Activity{}, false
+}
+
+// Returns the point balance of every user who has ledger entries.
+func GetBalancesFromDB() ([]Balance, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var balances []Balance
+	err = db.Model(&PointEntry{}).
+		Select("users.login AS login, SUM(point_entries.points) AS balance").
+		Joins("INNER JOIN users ON point_entries.user_id = users.id").
+		Group("users.id, users.login").
+		Order("balance DESC").Order("users.login").
+		Scan(&balances).Error
+	if err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
+
+// Receives the login, and returns the user's point balance and ledger entries, newest first.
+func GetUserPointsFromDB(login string) (*Balance, []PointEntry, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var user User
+	if err := db.Where("login = ?", login).First(&user).Error; err != nil {
+		return nil, nil, err
+	}
+	var entries []PointEntry
+	if err := db.Where("user_id = ?", user.ID).Order("created_at DESC").Order("id DESC").Find(&entries).Error; err != nil {
+		return nil, nil, err
+	}
+	balance := Balance{Login: user.Login}
+	for _, e := range entries {
+		balance.Balance += int64(e.Points)
+	}
+	return &balance, entries, nil
+}
+
+// Receives the login, points, reason, and who made it, and appends an adjustment to the ledger.
+func AddPointAdjustmentToDB(login string, points int, reason string, createdBy string) (*PointEntry, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := getUserIdFromLogin(db, login)
+	if err != nil {
+		return nil, err
+	}
+	entry := PointEntry{UserID: userId, Points: points, Kind: "adjustment", Reason: reason, CreatedBy: createdBy, CreatedAt: time.Now().Unix()}
+	if result := db.Create(&entry); result.Error != nil {
+		return nil, result.Error
+	}
+	return &entry, nil
+}
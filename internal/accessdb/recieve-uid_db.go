@@ -1,5 +1,9 @@
 package accessdb
 
+import (
+	"gorm.io/gorm"
+)
+
 // Receives the login and returns whether the login exists in the DB.
 func UserExists(login string) bool {
 	db, err := ConnectToDB()
@@ -14,8 +18,12 @@ func UserExists(login string) bool {
 	return true
 }
 
-// Receives the login and uid, and if the login does not have a uid, adds it.
-func AddUidToExistUser(login string, uid string) error {
+/*
+Receives the login and uid, and if the login does not have a uid, adds it.
+Taps of the card made before it was registered are credited to the user, the card is written to the outbox,
+and the change is written to the audit log.
+*/
+func AddUidToExistUser(login string, uid string, audit Audit) error {
 	db, err := ConnectToDB()
 	if err != nil {
 		return err
@@ -26,8 +34,31 @@ func AddUidToExistUser(login string, uid string) error {
 		return err
 	}
 
-	if err := db.Model(&user).Update("uid", uid).Error; err != nil {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		before := user
+		if err := tx.Model(&user).Update("uid", uid).Error; err != nil {
+			return err
+		}
+		user.UID = uid
+		if err := addAuditLog(tx, audit, "user.card_register", "user", user.Login, before, user); err != nil {
+			return err
+		}
+		if err := creditPendingTaps(tx, user); err != nil {
+			return err
+		}
+		return addCardEvent(tx, user)
+	})
+	if err != nil {
 		return err
 	}
+	notifyOutbox()
 	return nil
 }
+
+// Writes the card of the user to the outbox, if the user has one.
+func addCardEvent(tx *gorm.DB, user User) error {
+	if user.UID == "" {
+		return nil
+	}
+	return addOutboxEvent(tx, "user.card_registered", CardEvent{Login: user.Login, Uid: user.UID})
+}
@@ -0,0 +1,44 @@
+package accessdb
+
+import (
+	"gorm.io/gorm/clause"
+)
+
+// Receives the first and last dates, and returns the shifts in the range with their user and slot.
+func GetShiftsInRangeFromDB(start string, end string) ([]Shift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var shifts []Shift
+	if err := db.Preload("User").Preload("Slot.Location").Preload("Slot.Role").
+		Where("date >= ? AND date <= ?", start, end).Order("date").Order("id").Find(&shifts).Error; err != nil {
+		return nil, err
+	}
+	return shifts, nil
+}
+
+// Receives the IDs of shifts, and returns the reminders sent for them.
+func GetReminderLogsFromDB(shiftIds []uint) ([]ReminderLog, error) {
+	if len(shiftIds) == 0 {
+		return nil, nil
+	}
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var logs []ReminderLog
+	if err := db.Where("shift_id IN ?", shiftIds).Find(&logs).Error; err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// Records that the reminder was sent. Recording it again does nothing.
+func AddReminderLogToDB(reminderLog ReminderLog) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&reminderLog).Error
+}
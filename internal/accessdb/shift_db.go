@@ -1,8 +1,12 @@
 package accessdb
 
 import (
-	"gorm.io/gorm"
 	"database/sql"
+	"errors"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
 )
 
 // Receives the date and returns the shifts for that date.
@@ -12,7 +16,7 @@ func GetShiftFromDB(date string) ([]Shift, error) {
 		return nil, err
 	}
 	var shifts []Shift
-	if err := db.Preload("User").Where("date = ?", date).Find(&shifts).Error; err != nil {
+	if err := db.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Where("date = ?", date).Find(&shifts).Error; err != nil {
 		return nil, err
 	}
 	return shifts, nil
@@ -21,45 +25,185 @@ func GetShiftFromDB(date string) ([]Shift, error) {
 /*
 Receives an array of shifts, adds a shift that does not exist in the DB,
 and returns an array of added dates.
+A schedule with a time, location, or role is added to the matching slot,
+and fails with 409 if the slot has no room left, or 404 if the user, location or role is unknown.
+Each added shift is written to the outbox, and to the audit log as the actor of the audit.
 */
-func AddShiftToDB(schedule []Schedule) ([]string, error) {
+func AddShiftToDB(schedule []Schedule, audit Audit) (int, []string, error) {
 	db, err := ConnectToDB()
 	if err != nil {
-		return nil, err
+		return http.StatusInternalServerError, nil, err
 	}
 
 	var addedDate []string
-	var flag bool
 
 	for _, s := range schedule {
 		if s.Date == "" || len(s.Login) == 0 {
 			continue
 		}
-		flag = false
-		for _, l := range s.Login {
-			userId, err := getUserIdFromLogin(db, l)
-			if err != nil {
-				return nil, err
+		var flag bool
+		status := http.StatusOK
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var slotId *uint
+			if s.hasSlot() {
+				var slot *Slot
+				var err error
+				if status, slot, err = findOrCreateSlot(tx, s); err != nil {
+					return err
+				}
+				slotId = &slot.ID
 			}
-			var shift Shift
-			if err := db.Where("user_id = ? AND date = ?", userId, s.Date).First(&shift).Error; err != nil {
-				if err != gorm.ErrRecordNotFound {
-					return nil, err
+			for _, l := range s.Login {
+				userId, err := getUserIdFromLogin(tx, l)
+				if err != nil {
+					if err == gorm.ErrRecordNotFound {
+						status = http.StatusNotFound
+						return errors.New("User not found: " + l)
+					}
+					return err
+				}
+				var shift Shift
+				if err := whereShiftInSlot(tx, slotId).Where("user_id = ? AND date = ?", userId, s.Date).First(&shift).Error; err == nil {
+					continue
+				} else if err != gorm.ErrRecordNotFound {
+					return err
+				}
+				if slotId != nil {
+					if status, err = checkSlotCapacity(tx, *slotId); err != nil {
+						return err
+					}
+				}
+				shift = Shift{Date: s.Date, UserID: userId, SlotID: slotId}
+				if result := tx.Create(&shift); result.Error != nil {
+					return result.Error
+				}
+				if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Where("id = ?", shift.ID).First(&shift).Error; err != nil {
+					return err
+				}
+				if err := addShiftAuditLog(tx, audit, "shift.create", nil, shift); err != nil {
+					return err
 				}
-				shift = Shift{Date: s.Date, UserID: userId}
-				if result := db.Create(&shift); result.Error != nil {
-					return nil, result.Error
+				if err := addOutboxEvent(tx, "shift.created", shift); err != nil {
+					return err
 				}
 				flag = true
-			} else {
-				continue
 			}
+			return nil
+		}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+		if err != nil {
+			if status == http.StatusOK {
+				status = http.StatusInternalServerError
+			}
+			return status, nil, err
 		}
 		if flag {
 			addedDate = append(addedDate, s.Date)
 		}
 	}
-	return addedDate, nil
+	if len(addedDate) > 0 {
+		notifyOutbox()
+	}
+	return http.StatusOK, addedDate, nil
+}
+
+// Returns whether the schedule specifies a slot rather than a whole day.
+func (s Schedule) hasSlot() bool {
+	return s.StartTime != "" || s.EndTime != "" || s.Location != "" || s.Role != ""
+}
+
+/*
+Receives a schedule, and returns the slot with the same date, time, location and role.
+If there is no such slot, a new one is created. A non-zero capacity overwrites the stored one,
+but fails with 409 if it is below the shifts already booked in the slot.
+An unknown location or role fails with 404.
+*/
+func findOrCreateSlot(tx *gorm.DB, s Schedule) (int, *Slot, error) {
+	slot := Slot{Date: s.Date, StartTime: s.StartTime, EndTime: s.EndTime, Capacity: s.Capacity}
+	query := tx.Where("date = ? AND start_time = ? AND end_time = ?", s.Date, s.StartTime, s.EndTime)
+	if s.Location != "" {
+		var location Location
+		if err := tx.Where("name = ?", s.Location).First(&location).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return http.StatusNotFound, nil, errors.New("Location not found: " + s.Location)
+			}
+			return http.StatusInternalServerError, nil, err
+		}
+		slot.LocationId = &location.ID
+		query = query.Where("location_id = ?", location.ID)
+	} else {
+		query = query.Where("location_id IS NULL")
+	}
+	if s.Role != "" {
+		var role Role
+		if err := tx.Where("name = ?", s.Role).First(&role).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return http.StatusNotFound, nil, errors.New("Role not found: " + s.Role)
+			}
+			return http.StatusInternalServerError, nil, err
+		}
+		slot.RoleId = &role.ID
+		query = query.Where("role_id = ?", role.ID)
+	} else {
+		query = query.Where("role_id IS NULL")
+	}
+
+	var existingSlot Slot
+	if err := query.First(&existingSlot).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return http.StatusInternalServerError, nil, err
+		}
+		if result := tx.Create(&slot); result.Error != nil {
+			return http.StatusInternalServerError, nil, result.Error
+		}
+		return http.StatusOK, &slot, nil
+	}
+	if s.Capacity != 0 && s.Capacity != existingSlot.Capacity {
+		var count int64
+		if err := tx.Model(&Shift{}).Where("slot_id = ?", existingSlot.ID).Count(&count).Error; err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		if !CapacityFitsBooked(s.Capacity, count) {
+			return http.StatusConflict, nil, errors.New("Capacity is below the shifts already booked")
+		}
+		if err := tx.Model(&existingSlot).Update("capacity", s.Capacity).Error; err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+	}
+	return http.StatusOK, &existingSlot, nil
+}
+
+// Narrows the query to the shifts in the slot, or to the whole-day shifts if slotId is nil.
+func whereShiftInSlot(tx *gorm.DB, slotId *uint) *gorm.DB {
+	if slotId == nil {
+		return tx.Where("slot_id IS NULL")
+	}
+	return tx.Where("slot_id = ?", *slotId)
+}
+
+// Receives the slot ID, and returns 409 if the slot has already reached its capacity.
+func checkSlotCapacity(tx *gorm.DB, slotId uint) (int, error) {
+	var slot Slot
+	if err := tx.Where("id = ?", slotId).First(&slot).Error; err != nil {
+		return http.StatusInternalServerError, err
+	}
+	var count int64
+	if err := tx.Model(&Shift{}).Where("slot_id = ?", slotId).Count(&count).Error; err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if SlotIsFull(slot.Capacity, count) {
+		return http.StatusConflict, errors.New("Slot is full")
+	}
+	return http.StatusOK, nil
+}
+
+// Receives the capacity of a slot and the number of shifts booked in it, and returns whether no more can be booked.
+func SlotIsFull(capacity int, booked int64) bool {
+	return capacity != 0 && booked >= int64(capacity)
+}
+
+// Receives a new capacity of a slot and the number of shifts booked in it, and returns whether they all still fit.
+func CapacityFitsBooked(capacity int, booked int64) bool {
+	return capacity == 0 || booked <= int64(capacity)
 }
 
 // Receive the login and *gorm.DB, and return the user ID.
@@ -71,90 +215,324 @@ func getUserIdFromLogin(db *gorm.DB, login string) (int, error) {
 	return user.ID, nil
 }
 
-// Receives login and date, exchanges the shift, and returns the exchanged shift.
-func ExchangeShiftsOnDB(login1, login2, date1, date2 string) (*Shift, *Shift, error) {
+/*
+Receives login and date of each side, with the slot ID and the shift ID that tell which shift when given, exchanges the shifts, and returns the exchanged shifts.
+When a user has several shifts on that date, the slot ID or the shift ID must tell which one, otherwise it fails with 409.
+The exchange is written to the outbox, and the change of each shift to the audit log.
+*/
+func ExchangeShiftsOnDB(login1, login2, date1, date2 string, slotId1, slotId2 *uint, shiftId1, shiftId2 uint, audit Audit) (int, *Shift, *Shift, error) {
 	db, err := ConnectToDB()
 	if err != nil {
-		return nil, nil, err
+		return http.StatusInternalServerError, nil, nil, err
 	}
-	shift1, shift2, err := transactionExchange(db, login1, login2, date1, date2)
+	status, shift1, shift2, err := transactionExchange(db, login1, login2, date1, date2, slotId1, slotId2, shiftId1, shiftId2, audit)
 	if err != nil {
-		return nil, nil, err
+		return status, nil, nil, err
 	}
-	return shift1, shift2, nil
+	notifyOutbox()
+	return status, shift1, shift2, nil
 }
 
-func transactionExchange(db *gorm.DB, login1, login2, date1, date2 string) (*Shift, *Shift, error) {
+func transactionExchange(db *gorm.DB, login1, login2, date1, date2 string, slotId1, slotId2 *uint, shiftId1, shiftId2 uint, audit Audit) (int, *Shift, *Shift, error) {
+	status := http.StatusOK
 	var shift1, shift2 Shift
-	
+
 	err := db.Transaction(func(tx *gorm.DB) error {
-		userId1, err := getUserIdFromLogin(tx, login1)
-		if err != nil {
+		var selected1, selected2 *Shift
+		var err error
+		if status, selected1, err = findShift(tx, login1, date1, slotId1, shiftId1); err != nil {
 			return err
 		}
-		userId2, err := getUserIdFromLogin(tx, login2)
-		if err != nil {
+		if status, selected2, err = findShift(tx, login2, date2, slotId2, shiftId2); err != nil {
 			return err
 		}
-		if err := tx.Where("user_id = ? AND date = ?", userId1, date1).First(&shift1).Error; err != nil {
+		shift1, shift2 = *selected1, *selected2
+		userId1, userId2 := shift1.UserID, shift2.UserID
+		before1, before2 := shift1, shift2
+		if err := tx.Model(&shift1).Omit("User", "Slot").Updates(map[string]interface{}{"user_id": userId2, "revision": gorm.Expr("revision + 1")}).Error; err != nil {
 			return err
 		}
-		if err := tx.Where("user_id = ? AND date = ?", userId2, date2).First(&shift2).Error; err != nil {
+		if err := tx.Model(&shift2).Omit("User", "Slot").Updates(map[string]interface{}{"user_id": userId1, "revision": gorm.Expr("revision + 1")}).Error; err != nil {
 			return err
 		}
-		if err := tx.Model(&shift1).Update("user_id", userId2).Error; err != nil {
+		if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Where("id = ?", shift1.ID).First(&shift1).Error; err != nil {
 			return err
 		}
-		if err := tx.Model(&shift2).Update("user_id", userId1).Error; err != nil {
+		if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Where("id = ?", shift2.ID).First(&shift2).Error; err != nil {
 			return err
 		}
-		if err := tx.Preload("User").Where("id = ?", shift1.ID).First(&shift1).Error; err != nil {
+		if err := addShiftAuditLog(tx, audit, "shift.exchange", before1, shift1); err != nil {
 			return err
 		}
-		if err := tx.Preload("User").Where("id = ?", shift2.ID).First(&shift2).Error; err != nil {
+		if err := addShiftAuditLog(tx, audit, "shift.exchange", before2, shift2); err != nil {
 			return err
 		}
-		return nil
+		return addOutboxEvent(tx, "shift.exchanged", []Shift{shift1, shift2})
 	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
-		return nil, nil, err
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return status, nil, nil, err
+	}
+	return status, &shift1, &shift2, nil
+}
+
+/*
+Receives login and date, or the shift ID, with the slot ID that may be nil, and returns the one shift they tell.
+Returns 404 if the user or the shift is not found, and 409 if several shifts match.
+*/
+func findShift(tx *gorm.DB, login, date string, slotId *uint, shiftId uint) (int, *Shift, error) {
+	query := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role")
+	if login != "" {
+		userId, err := getUserIdFromLogin(tx, login)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return http.StatusNotFound, nil, errors.New("User not found: " + login)
+			}
+			return http.StatusInternalServerError, nil, err
+		}
+		query = query.Where("user_id = ?", userId)
+	}
+	if date != "" {
+		query = query.Where("date = ?", date)
 	}
-	return &shift1, &shift2, nil
+	if shiftId != 0 {
+		query = query.Where("id = ?", shiftId)
+	}
+	var shifts []Shift
+	if err := query.Order("id").Find(&shifts).Error; err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	return SelectShift(shifts, slotId)
 }
 
-// Receives login and date, deletes the shift, and returns the deleted shift.
-func DeleteShiftFromDB(login, date string) (*Shift, error) {
+/*
+Receives login and date, or the shift ID, deletes the shift as the actor of the audit, and returns the deleted shift.
+When the user has several shifts on that date, the slot ID or the shift ID must tell which one, otherwise it fails with 409.
+The deletion is written to the outbox and to the audit log.
+*/
+func DeleteShiftFromDB(login, date string, slotId *uint, shiftId uint, reason string, audit Audit) (int, *Shift, error) {
 	db, err := ConnectToDB()
 	if err != nil {
-		return nil, err
+		return http.StatusInternalServerError, nil, err
 	}
-	shift, err := transactionDelete(db, login, date)
+	status, shift, err := transactionDelete(db, login, date, slotId, shiftId, reason, audit)
 	if err != nil {
-		return nil, err
+		return status, nil, err
 	}
-	return shift, nil
+	notifyOutbox()
+	return status, shift, nil
 }
 
-func transactionDelete(db *gorm.DB, login, date string) (*Shift, error) {
+func transactionDelete(db *gorm.DB, login, date string, slotId *uint, shiftId uint, reason string, audit Audit) (int, *Shift, error) {
+	status := http.StatusOK
 	var shift Shift
 	err := db.Transaction(func(tx *gorm.DB) error {
-		userId, err := getUserIdFromLogin(tx, login)
-		if err != nil {
+		var selected *Shift
+		var err error
+		if status, selected, err = findShift(tx, login, date, slotId, shiftId); err != nil {
 			return err
 		}
-		if err := tx.Where("user_id = ? AND date = ?", userId, date).First(&shift).Error; err != nil {
+		shift = *selected
+		before := shift
+		if err := softDeleteShift(tx, &shift, audit.Actor, reason); err != nil {
 			return err
 		}
-		if err := tx.Delete(&shift).Error; err != nil {
+		if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Unscoped().Where("id = ?", shift.ID).First(&shift).Error; err != nil {
+			return err
+		}
+		if err := addShiftAuditLog(tx, audit, "shift.delete", before, shift); err != nil {
+			return err
+		}
+		return addOutboxEvent(tx, "shift.deleted", shift)
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return status, nil, err
+	}
+	return status, &shift, nil
+}
+
+/*
+Receives the shifts that match the request and the slot ID, which may be nil, and returns the one shift it tells.
+Returns 404 if none is left in the slot, and 409 if several are left, since the request is ambiguous.
+*/
+func SelectShift(shifts []Shift, slotId *uint) (int, *Shift, error) {
+	var matched []Shift
+	for _, shift := range shifts {
+		if slotId != nil && (shift.SlotID == nil || *shift.SlotID != *slotId) {
+			continue
+		}
+		matched = append(matched, shift)
+	}
+	if len(matched) == 0 {
+		return http.StatusNotFound, nil, errors.New("Shift not found")
+	}
+	if len(matched) > 1 {
+		return http.StatusConflict, nil, errors.New("Several shifts match, specify slot_id or shift_id")
+	}
+	return http.StatusOK, &matched[0], nil
+}
+
+/*
+Receives the first and last dates, and deletes all shifts in that range in one transaction.
+The shifts can be narrowed by login and by the location of their slot.
+Returns the deleted shifts, each of which is written to the outbox and to the audit log.
+*/
+func DeleteShiftsInRangeFromDB(start, end, login, location, reason string, audit Audit) (int, []Shift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	status := http.StatusInternalServerError
+	var shifts []Shift
+	err = db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Where("date >= ? AND date <= ?", start, end)
+		if login != "" {
+			userId, err := getUserIdFromLogin(tx, login)
+			if err != nil {
+				if err == gorm.ErrRecordNotFound {
+					status = http.StatusNotFound
+					return errors.New("User not found: " + login)
+				}
+				return err
+			}
+			query = query.Where("user_id = ?", userId)
+		}
+		if location != "" {
+			var l Location
+			if err := tx.Where("name = ?", location).First(&l).Error; err != nil {
+				if err == gorm.ErrRecordNotFound {
+					status = http.StatusNotFound
+					return errors.New("Location not found: " + location)
+				}
+				return err
+			}
+			query = query.Where("slot_id IN (?)", tx.Model(&Slot{}).Select("id").Where("location_id = ?", l.ID))
+		}
+		if err := query.Find(&shifts).Error; err != nil {
 			return err
 		}
-		if err := tx.Preload("User").Unscoped().Where("id = ?", shift.ID).First(&shift).Error; err != nil {
+		if len(shifts) == 0 {
+			return nil
+		}
+		var ids []uint
+		before := make(map[uint]Shift)
+		for i := range shifts {
+			before[shifts[i].ID] = shifts[i]
+			if err := softDeleteShift(tx, &shifts[i], audit.Actor, reason); err != nil {
+				return err
+			}
+			ids = append(ids, shifts[i].ID)
+		}
+		if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Unscoped().Where("id IN ?", ids).Order("date").Order("id").Find(&shifts).Error; err != nil {
 			return err
 		}
+		for _, shift := range shifts {
+			if err := addShiftAuditLog(tx, audit, "shift.delete", before[shift.ID], shift); err != nil {
+				return err
+			}
+			if err := addOutboxEvent(tx, "shift.deleted", shift); err != nil {
+				return err
+			}
+		}
 		return nil
 	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return status, nil, err
+	}
+	notifyOutbox()
+	return http.StatusOK, shifts, nil
+}
+
+// Writes the change of the shift to the audit log. before is nil for a shift that has just been created.
+func addShiftAuditLog(tx *gorm.DB, audit Audit, action string, before interface{}, after Shift) error {
+	return addAuditLog(tx, audit, action, "shift", strconv.FormatUint(uint64(after.ID), 10), before, after)
+}
+
+// Records who deleted the shift and why, and soft deletes it. The revision is bumped for calendars to pick up the change.
+func softDeleteShift(tx *gorm.DB, shift *Shift, deletedBy, reason string) error {
+	if err := tx.Model(shift).Omit("User", "Slot").Updates(map[string]interface{}{"deleted_by": deletedBy, "delete_reason": reason, "revision": gorm.Expr("revision + 1")}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(shift).Error
+}
+
+// Receives the first and last dates, and returns the shifts deleted in that range.
+func GetDeletedShiftsFromDB(start, end string) ([]Shift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var shifts []Shift
+	err = db.Unscoped().Preload("User").Preload("Slot.Location").Preload("Slot.Role").
+		Where("deleted_at IS NOT NULL AND date >= ? AND date <= ?", start, end).
+		Order("date").Order("id").
+		Find(&shifts).Error
 	if err != nil {
 		return nil, err
 	}
-	return &shift, nil
+	return shifts, nil
+}
+
+/*
+Receives the shift ID, and restores the deleted shift as the actor of the audit.
+Who deleted it and why are kept, and who restored it and when are recorded next to them.
+Fails if the user already has the same shift again, or its slot is full. The restore is written to the outbox and the audit log.
+*/
+func RestoreShiftOnDB(id uint, audit Audit) (int, *Shift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	status := http.StatusOK
+	var shift Shift
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Unscoped().Where("id = ?", id).First(&shift).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				status = http.StatusNotFound
+			}
+			return err
+		}
+		if !shift.DeletedAt.Valid {
+			status = http.StatusConflict
+			return errors.New("Shift is not deleted")
+		}
+		var existingShift Shift
+		if err := whereShiftInSlot(tx, shift.SlotID).Where("user_id = ? AND date = ?", shift.UserID, shift.Date).First(&existingShift).Error; err == nil {
+			status = http.StatusConflict
+			return errors.New("Shift already exists")
+		} else if err != gorm.ErrRecordNotFound {
+			return err
+		}
+		if shift.SlotID != nil {
+			if status, err = checkSlotCapacity(tx, *shift.SlotID); err != nil {
+				return err
+			}
+		}
+		before := shift
+		if err := tx.Unscoped().Model(&shift).Omit("User", "Slot").Updates(map[string]interface{}{"deleted_at": nil, "restored_by": audit.Actor, "restored_at": time.Now().Unix(), "revision": gorm.Expr("revision + 1")}).Error; err != nil {
+			return err
+		}
+		if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Where("id = ?", shift.ID).First(&shift).Error; err != nil {
+			return err
+		}
+		if err := addShiftAuditLog(tx, audit, "shift.restore", before, shift); err != nil {
+			return err
+		}
+		return addOutboxEvent(tx, "shift.restored", shift)
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return status, nil, err
+	}
+	notifyOutbox()
+	return status, &shift, nil
 }
@@ -0,0 +1,194 @@
+package accessdb
+
+import (
+	"database/sql"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Receives the date and returns the open slots for that date with the number of shifts taken.
+func GetOpenSlotsFromDB(date string) ([]Slot, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var slots []Slot
+	if err := db.Preload("Location").Preload("Role").Where("date = ? AND open = ?", date, true).Order("start_time").Find(&slots).Error; err != nil {
+		return nil, err
+	}
+	for i := range slots {
+		if err := db.Model(&Shift{}).Where("slot_id = ?", slots[i].ID).Count(&slots[i].Taken).Error; err != nil {
+			return nil, err
+		}
+	}
+	return slots, nil
+}
+
+// Receives a schedule without logins, and publishes its slot so that students can claim it.
+func AddOpenSlotToDB(s Schedule) (int, *Slot, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	status := http.StatusOK
+	var slot *Slot
+	err = db.Transaction(func(tx *gorm.DB) error {
+		status, slot, err = findOrCreateSlot(tx, s)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(slot).Update("open", true).Error; err != nil {
+			return err
+		}
+		return tx.Preload("Location").Preload("Role").Where("id = ?", slot.ID).First(slot).Error
+	})
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return status, nil, err
+	}
+	return status, slot, nil
+}
+
+/*
+Receives the slot ID, login, and who made the request, and adds a shift of the login to the open slot.
+The slot row is locked while counting, so concurrent claims cannot exceed the capacity.
+Claims are closed once the slot starts within the cutoff. The creation is written to the audit log and the outbox.
+*/
+func ClaimSlotOnDB(slotId uint, login string, cutoff time.Duration, audit Audit) (int, *Shift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	status := http.StatusOK
+	var shift Shift
+	err = db.Transaction(func(tx *gorm.DB) error {
+		slot, s, err := lockOpenSlot(tx, slotId, cutoff)
+		if err != nil {
+			status = s
+			return err
+		}
+		userId, err := getUserIdFromLogin(tx, login)
+		if err != nil {
+			status = http.StatusNotFound
+			return err
+		}
+		if err := tx.Where("slot_id = ? AND user_id = ?", slot.ID, userId).First(&shift).Error; err == nil {
+			status = http.StatusConflict
+			return errors.New("Slot is already claimed")
+		} else if err != gorm.ErrRecordNotFound {
+			status = http.StatusInternalServerError
+			return err
+		}
+		if status, err = checkSlotCapacity(tx, slot.ID); err != nil {
+			return err
+		}
+		shift = Shift{Date: slot.Date, UserID: userId, SlotID: &slot.ID}
+		if err := tx.Create(&shift).Error; err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Where("id = ?", shift.ID).First(&shift).Error; err != nil {
+			return err
+		}
+		if err := addAuditLog(tx, audit, "shift.claim", "shift", strconv.FormatUint(uint64(shift.ID), 10), nil, shift); err != nil {
+			return err
+		}
+		return addOutboxEvent(tx, "shift.created", shift)
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return status, nil, err
+	}
+	notifyOutbox()
+	return status, &shift, nil
+}
+
+/*
+Receives the slot ID, login, and who made the request, and deletes the shift of the login from the open slot.
+The deletion is written to the audit log and the outbox.
+*/
+func ReleaseSlotOnDB(slotId uint, login string, cutoff time.Duration, audit Audit) (int, *Shift, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	status := http.StatusOK
+	var shift Shift
+	err = db.Transaction(func(tx *gorm.DB) error {
+		slot, s, err := lockOpenSlot(tx, slotId, cutoff)
+		if err != nil {
+			status = s
+			return err
+		}
+		userId, err := getUserIdFromLogin(tx, login)
+		if err != nil {
+			status = http.StatusNotFound
+			return err
+		}
+		if err := tx.Where("slot_id = ? AND user_id = ?", slot.ID, userId).First(&shift).Error; err != nil {
+			status = http.StatusNotFound
+			return err
+		}
+		before := shift
+		if err := softDeleteShift(tx, &shift, login, "Released by the user"); err != nil {
+			status = http.StatusInternalServerError
+			return err
+		}
+		if err := tx.Preload("User").Preload("Slot.Location").Preload("Slot.Role").Unscoped().Where("id = ?", shift.ID).First(&shift).Error; err != nil {
+			return err
+		}
+		if err := addShiftAuditLog(tx, audit, "shift.release", before, shift); err != nil {
+			return err
+		}
+		return addOutboxEvent(tx, "shift.deleted", shift)
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return status, nil, err
+	}
+	notifyOutbox()
+	return status, &shift, nil
+}
+
+// Locks the slot row for update, and checks that it is open and does not start within the cutoff.
+func lockOpenSlot(tx *gorm.DB, slotId uint, cutoff time.Duration) (*Slot, int, error) {
+	var slot Slot
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", slotId).First(&slot).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, http.StatusNotFound, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	if !slot.Open {
+		return nil, http.StatusForbidden, errors.New("Slot is not open")
+	}
+	startsAt, err := slot.StartsAt()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if time.Now().Add(cutoff).After(startsAt) {
+		return nil, http.StatusForbidden, errors.New("Slot can no longer be changed")
+	}
+	return &slot, http.StatusOK, nil
+}
+
+// Returns the time the slot starts. A slot without a start time starts at the beginning of its date.
+func (s Slot) StartsAt() (time.Time, error) {
+	startTime := s.StartTime
+	if startTime == "" {
+		startTime = "00:00"
+	}
+	return time.ParseInLocation("2006-01-02 15:04", s.Date+" "+startTime, time.Local)
+}
@@ -0,0 +1,106 @@
+package accessdb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The format of the time of the activity that each grouping by time groups by.
+var activityStatDateFormats = map[string]string{
+	"day":   "%Y-%m-%d",
+	"week":  "%x-W%v",
+	"month": "%Y-%m",
+}
+
+// The SQL expression that each of the other groupings of the activity statistics groups by.
+var activityStatGroups = map[string]string{
+	"role":     "roles.name",
+	"location": "COALESCE(locations.name, '')",
+	"user":     "users.login",
+}
+
+/*
+Receives the grouping and the time range, and returns the SQL expression to group by.
+FROM_UNIXTIME follows the time zone of the DB session, so the groupings by time add the offset
+the zone of the range has at the time of each activity instead.
+*/
+func ActivityStatGroup(groupBy string, start time.Time, end time.Time) (string, bool) {
+	if format, ok := activityStatDateFormats[groupBy]; ok {
+		local := "DATE_ADD('1970-01-01 00:00:00', INTERVAL activities.created_at + " + LocalOffsetSQL("activities.created_at", start, end) + " SECOND)"
+		return "DATE_FORMAT(" + local + ", '" + format + "')", true
+	}
+	group, ok := activityStatGroups[groupBy]
+	return group, ok
+}
+
+/*
+Receives the column of a unix time and the time range, and returns the SQL expression of the offset in seconds
+that the zone of the range has at that time. When the offset changes in the range, as it does at DST,
+the expression compares the column with each change, so that every row gets its own offset.
+*/
+func LocalOffsetSQL(column string, start time.Time, end time.Time) string {
+	_, offset := start.Zone()
+	var cases strings.Builder
+	// Step from one change of the zone to the next, which ZoneBounds returns as the end of the current one.
+	for t := start; ; {
+		_, next := t.ZoneBounds()
+		if next.IsZero() || !next.Before(end) {
+			break
+		}
+		if _, nextOffset := next.Zone(); nextOffset != offset {
+			fmt.Fprintf(&cases, "WHEN %s < %d THEN %d ", column, next.Unix(), offset)
+			offset = nextOffset
+		}
+		t = next
+	}
+	if cases.Len() == 0 {
+		return fmt.Sprintf("%d", offset)
+	}
+	return fmt.Sprintf("(CASE %sELSE %d END)", cases.String(), offset)
+}
+
+/*
+Receives the time range, the grouping, and the role, location, and login to narrow the activities to,
+and returns the number of taps and unique users in each group, counted in SQL.
+The grouping is one of day, week (ISO), month, role, location, and user.
+Grouped by user, the users who opted out of the leaderboard are left out, as it would rank them the same way.
+*/
+func GetActivityStatsFromDB(startTime int64, endTime int64, groupBy string, role string, location string, login string) (int, []ActivityStat, error) {
+	group, ok := ActivityStatGroup(groupBy, time.Unix(startTime, 0), time.Unix(endTime, 0))
+	if !ok {
+		return http.StatusBadRequest, nil, errors.New("group_by must be one of day, week, month, role, location, and user")
+	}
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	query := db.Model(&Activity{}).
+		Select(group+" AS `group`, COUNT(*) AS count, COUNT(DISTINCT activities.user_id) AS users").
+		Joins("INNER JOIN users ON activities.user_id = users.id").
+		Joins("INNER JOIN m5_sticks ON activities.m5_stick_id = m5_sticks.id").
+		Joins("INNER JOIN roles ON m5_sticks.role_id = roles.id").
+		Joins("LEFT JOIN locations ON m5_sticks.location_id = locations.id").
+		Where("activities.created_at >= ? AND activities.created_at < ?", startTime, endTime)
+	if role != "" {
+		query = query.Where("roles.name = ?", role)
+	}
+	if location != "" {
+		query = query.Where("locations.name = ?", location)
+	}
+	if login != "" {
+		query = query.Where("users.login = ?", login)
+	}
+	if groupBy == "user" {
+		query = query.Where("users.leaderboard_off = ?", false)
+	}
+
+	var stats []ActivityStat
+	if err := query.Group(group).Order("`group`").Scan(&stats).Error; err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	return http.StatusOK, stats, nil
+}
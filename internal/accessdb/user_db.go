@@ -1,6 +1,7 @@
 package accessdb
 
 import (
+	"42ActivityAPI/internal/wallet"
 	"errors"
 	"gorm.io/gorm"
 )
@@ -8,13 +9,24 @@ import (
 /*
 Receives an array of users and updates the login if it exists in the DB,
 or creates a new one if it doesn't. Returns the array of users reflected in the DB.
+Wallets are checked before any user is changed, and each user is changed in its own transaction,
+in which pending taps of the user's card are credited, a newly registered card is written to the outbox,
+and the change is written to the audit log.
 */
-func AddUsersToDB(users []UserRequestData) ([]string, error) {
+func AddUsersToDB(users []UserRequestData, audit Audit) ([]string, error) {
 	var addedLogin []string
 	db, err := ConnectToDB()
 	if err != nil {
 		return addedLogin, err
 	}
+	for i, u := range users {
+		if u.Wallet == "" {
+			continue
+		}
+		if users[i].Wallet, err = wallet.NormalizeAddress(u.Wallet); err != nil {
+			return addedLogin, errors.New(u.Login + ": " + err.Error())
+		}
+	}
 	for _, u := range users {
 		var user User
 		if u.Login == "" {
@@ -25,23 +37,37 @@ func AddUsersToDB(users []UserRequestData) ([]string, error) {
 				return addedLogin, err
 			}
 		} else {
-			if result := db.Model(&user).Updates(User{UID: u.Uid, Wallet: u.Wallet}); result.Error != nil {
-				return addedLogin, result.Error
+			if err := updateUser(db, user, u.Uid, u.Wallet, audit); err != nil {
+				return addedLogin, err
 			}
+			notifyOutbox()
 			addedLogin = append(addedLogin, u.Login)
 			continue
 		}
 		user = User{UID: u.Uid, Login: u.Login, Wallet: u.Wallet}
-		if result := db.Create(&user); result.Error != nil {
-			return addedLogin, result.Error
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if result := tx.Create(&user); result.Error != nil {
+				return result.Error
+			}
+			if err := creditPendingTaps(tx, user); err != nil {
+				return err
+			}
+			if err := addAuditLog(tx, audit, "user.create", "user", user.Login, nil, user); err != nil {
+				return err
+			}
+			return addCardEvent(tx, user)
+		})
+		if err != nil {
+			return addedLogin, err
 		}
+		notifyOutbox()
 		addedLogin = append(addedLogin, u.Login)
 	}
 	return addedLogin, nil
 }
 
 // Receive uid, login, and wallet, and if the same login exists in the DB, update the user data.
-func EditUserInDB(uid string, login string, wallet string) error {
+func EditUserInDB(uid string, login string, address string, audit Audit) error {
 	db, err := ConnectToDB()
 	if err != nil {
 		return err
@@ -51,15 +77,51 @@ func EditUserInDB(uid string, login string, wallet string) error {
 	if err := db.Where("login = ?", login).First(&existingUser).Error; err != nil {
 		return err
 	}
-
-	if result := db.Model(&existingUser).Updates(User{UID: uid, Wallet: wallet}); result.Error != nil {
-		return result.Error
+	if err := updateUser(db, existingUser, uid, address, audit); err != nil {
+		return err
 	}
+	notifyOutbox()
 	return nil
 }
 
+/*
+Receives the user and the uid and wallet given for it, and updates the user in a transaction.
+Pending taps of the card are credited, a changed card is written to the outbox, and a change is written to the audit log.
+*/
+func updateUser(db *gorm.DB, user User, uid string, address string, audit Audit) error {
+	updates, err := userUpdates(user, uid, address)
+	if err != nil {
+		return err
+	}
+	cardChanged := uid != "" && uid != user.UID
+	return db.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			before := user
+			if result := tx.Model(&user).Updates(updates); result.Error != nil {
+				return result.Error
+			}
+			if err := tx.Where("id = ?", user.ID).First(&user).Error; err != nil {
+				return err
+			}
+			if err := addAuditLog(tx, audit, "user.update", "user", user.Login, before, user); err != nil {
+				return err
+			}
+		}
+		if uid != "" {
+			user.UID = uid
+		}
+		if err := creditPendingTaps(tx, user); err != nil {
+			return err
+		}
+		if cardChanged {
+			return addCardEvent(tx, user)
+		}
+		return nil
+	})
+}
+
 // Receives uid, login, and wallet, and if the same login does not exist in the DB, adds a new user.
-func AddUserToDB(uid string, login string, wallet string) error {
+func AddUserToDB(uid string, login string, address string, audit Audit) error {
 	db, err := ConnectToDB()
 	if err != nil {
 		return err
@@ -73,10 +135,50 @@ func AddUserToDB(uid string, login string, wallet string) error {
 	} else {
 		return errors.New("User already exists")
 	}
-	user := User{UID: uid, Login: login, Wallet: wallet}
+	if address != "" {
+		if address, err = wallet.NormalizeAddress(address); err != nil {
+			return err
+		}
+	}
+	user := User{UID: uid, Login: login, Wallet: address}
 
-	if result := db.Create(&user); result.Error != nil {
-		return result.Error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Create(&user); result.Error != nil {
+			return result.Error
+		}
+		if err := creditPendingTaps(tx, user); err != nil {
+			return err
+		}
+		if err := addAuditLog(tx, audit, "user.create", "user", user.Login, nil, user); err != nil {
+			return err
+		}
+		return addCardEvent(tx, user)
+	})
+	if err != nil {
+		return err
 	}
+	notifyOutbox()
 	return nil
 }
+
+/*
+Receives the user and the uid and wallet given for it, and returns the columns to update.
+The wallet is stored in the checksum form, and a changed wallet has to be verified again.
+*/
+func userUpdates(user User, uid string, address string) (map[string]interface{}, error) {
+	updates := make(map[string]interface{})
+	if uid != "" {
+		updates["uid"] = uid
+	}
+	if address != "" {
+		normalized, err := wallet.NormalizeAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		if normalized != user.Wallet {
+			updates["wallet"] = normalized
+			updates["wallet_verified"] = false
+		}
+	}
+	return updates, nil
+}
@@ -0,0 +1,106 @@
+package accessdb
+
+import (
+	"42ActivityAPI/internal/wallet"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// Returns the message the user signs with the wallet for the challenge.
+func (c WalletChallenge) Message(login string) string {
+	return fmt.Sprintf("42ActivityAPI wallet verification\nLogin: %s\nWallet: %s\nNonce: %s", login, c.Wallet, c.Nonce)
+}
+
+/*
+Receives the login, wallet, and how long the challenge lasts, and issues a new nonce for the user to sign.
+A user has at most one challenge, so issuing another one replaces it.
+*/
+func AddWalletChallengeToDB(login string, address string, ttl time.Duration) (*WalletChallenge, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	address, err = wallet.NormalizeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := getUserIdFromLogin(db, login)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var challenge WalletChallenge
+	if err := db.Where("user_id = ?", userId).First(&challenge).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	challenge.UserID = userId
+	challenge.Wallet = address
+	challenge.Nonce = nonce
+	challenge.ExpiresAt = time.Now().Add(ttl).Unix()
+	if err := db.Save(&challenge).Error; err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+/*
+Receives the login and the signature of the challenge message, and if the signature was made
+with the wallet of the challenge, sets it as the user's verified wallet. The challenge can be used only once.
+The change of the user is written to the audit log.
+*/
+func VerifyWalletOnDB(login string, signature string, audit Audit) (int, *User, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	var user User
+	if err := db.Where("login = ?", login).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return http.StatusNotFound, nil, err
+		}
+		return http.StatusInternalServerError, nil, err
+	}
+	var challenge WalletChallenge
+	if err := db.Where("user_id = ?", user.ID).First(&challenge).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return http.StatusNotFound, nil, errors.New("Challenge not found")
+		}
+		return http.StatusInternalServerError, nil, err
+	}
+	if time.Now().Unix() > challenge.ExpiresAt {
+		return http.StatusGone, nil, errors.New("Challenge has expired")
+	}
+	signer, err := wallet.RecoverAddress(challenge.Message(user.Login), signature)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	if signer != challenge.Wallet {
+		return http.StatusUnauthorized, nil, errors.New("Signature does not match the wallet")
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		before := user
+		if err := tx.Model(&user).Updates(map[string]interface{}{"wallet": challenge.Wallet, "wallet_verified": true}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", user.ID).First(&user).Error; err != nil {
+			return err
+		}
+		if err := addAuditLog(tx, audit, "user.wallet_verify", "user", user.Login, before, user); err != nil {
+			return err
+		}
+		return tx.Delete(&challenge).Error
+	})
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	return http.StatusOK, &user, nil
+}
@@ -0,0 +1,195 @@
+package accessdb
+
+import (
+	"database/sql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+// Returns whether the webhook subscribes to the event type.
+func (w Webhook) Subscribes(eventType string) bool {
+	for _, e := range strings.Split(w.Events, ",") {
+		if e == "*" || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Receives the URL, the event types, the secret, and who made it, and adds the webhook.
+If the secret is empty, a random one is generated. The webhook is returned with its secret.
+*/
+func AddWebhookToDB(url string, eventTypes []string, secret string, createdBy string) (*Webhook, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		if secret, err = generateToken(); err != nil {
+			return nil, err
+		}
+	}
+	webhook := Webhook{URL: url, Events: strings.Join(eventTypes, ","), Secret: secret, CreatedBy: createdBy, CreatedAt: time.Now().Unix()}
+	if err := db.Create(&webhook).Error; err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// Returns the webhooks that are not deleted.
+func GetWebhooksFromDB() ([]Webhook, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []Webhook
+	if err := db.Order("id").Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+/*
+Receives the ID, and deletes the webhook. Its pending deliveries are failed,
+and the delivery log is kept.
+*/
+func DeleteWebhookFromDB(id uint) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var webhook Webhook
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&webhook).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&WebhookDelivery{}).Where("webhook_id = ? AND status = ?", id, "pending").
+			Updates(map[string]interface{}{"status": "failed", "error": "Webhook was deleted"}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&webhook).Error
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+}
+
+/*
+Receives an event and its payload, and queues a delivery to each webhook subscribing to the event type.
+An event already queued for a webhook is not queued again. Returns the number of queued deliveries.
+*/
+func QueueWebhookDeliveriesOnDB(eventID int64, eventType string, payload string) (int, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return 0, err
+	}
+	var webhooks []Webhook
+	if err := db.Find(&webhooks).Error; err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	var deliveries []WebhookDelivery
+	for _, w := range webhooks {
+		if w.Subscribes(eventType) {
+			deliveries = append(deliveries, WebhookDelivery{WebhookID: w.ID, EventID: eventID, EventType: eventType, Payload: payload, Status: "pending", NextAttemptAt: now, CreatedAt: now})
+		}
+	}
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&deliveries)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return int(result.RowsAffected), nil
+}
+
+/*
+Receives the current time, the time to claim them until, and a limit, and returns the pending deliveries due by then
+with their webhook, oldest first. The deliveries are locked with SKIP LOCKED and their next attempt is moved to the claim
+in the same transaction, so that other instances and later passes skip them instead of posting them twice.
+A delivery whose attempt is never recorded, as when the instance stops, is due again once the claim runs out.
+*/
+func ClaimDueWebhookDeliveriesOnDB(now int64, claimUntil int64, limit int) ([]WebhookDelivery, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []WebhookDelivery
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Preload("Webhook").
+			Where("status = ? AND next_attempt_at <= ?", "pending", now).
+			Order("next_attempt_at").Order("id").Limit(limit).Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+		ids := make([]uint, len(deliveries))
+		for i := range deliveries {
+			ids[i] = deliveries[i].ID
+			deliveries[i].NextAttemptAt = claimUntil
+		}
+		return tx.Model(&WebhookDelivery{}).Where("id IN ?", ids).Update("next_attempt_at", claimUntil).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Receives a delivery after an attempt, and saves the result of the attempt.
+func RecordWebhookAttemptOnDB(delivery *WebhookDelivery) error {
+	db, err := ConnectToDB()
+	if err != nil {
+		return err
+	}
+	return db.Model(delivery).Select("Status", "Attempts", "ResponseCode", "Error", "NextAttemptAt", "DeliveredAt").Updates(delivery).Error
+}
+
+/*
+Receives the webhook ID, a status to narrow them by, and a limit, and returns the deliveries of the webhook, newest first.
+The webhook may already be deleted.
+*/
+func GetWebhookDeliveriesFromDB(webhookID uint, status string, limit int) ([]WebhookDelivery, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Unscoped().Where("id = ?", webhookID).First(&Webhook{}).Error; err != nil {
+		return nil, err
+	}
+	query := db.Where("webhook_id = ?", webhookID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var deliveries []WebhookDelivery
+	if err := query.Order("id DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Receives the ID of a delivery, and queues it again with its attempts reset, unless its webhook is deleted.
+func RedeliverWebhookDeliveryOnDB(id uint) (*WebhookDelivery, error) {
+	db, err := ConnectToDB()
+	if err != nil {
+		return nil, err
+	}
+	var delivery WebhookDelivery
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&delivery).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", delivery.WebhookID).First(&Webhook{}).Error; err != nil {
+			return err
+		}
+		delivery.Status = "pending"
+		delivery.Attempts = 0
+		delivery.Error = ""
+		delivery.NextAttemptAt = time.Now().Unix()
+		return tx.Model(&delivery).Select("Status", "Attempts", "Error", "NextAttemptAt").Updates(&delivery).Error
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
@@ -0,0 +1,139 @@
+package escalation
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/notify"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+Finds the shifts missed in the last days, and notifies the students and, once a student has missed
+too many shifts in the period, staff. Each channel that accepted a notification is recorded, and the miss is
+marked as notified only after every channel accepted it, so a failed channel alone is sent it again at the next check.
+*/
+type Escalator struct {
+	notifiers    []notify.Notifier
+	staff        []string
+	rule         accessdb.MissRule
+	lookbackDays int
+}
+
+func NewEscalator(notifiers []notify.Notifier, staff []string, rule accessdb.MissRule, lookbackDays int) *Escalator {
+	return &Escalator{notifiers: notifiers, staff: staff, rule: rule, lookbackDays: lookbackDays}
+}
+
+// Checks for missed shifts at the interval until the context is done.
+func (e *Escalator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			e.Check(ctx, t)
+		}
+	}
+}
+
+// Detects the shifts missed up to yesterday, and sends the notifications that were not sent yet.
+func (e *Escalator) Check(ctx context.Context, now time.Time) {
+	// Only days that are over are checked, since a student can still show up today.
+	start := now.AddDate(0, 0, -e.lookbackDays).Format("2006-01-02")
+	end := now.AddDate(0, 0, -1).Format("2006-01-02")
+	if _, err := accessdb.DetectMissedShiftsOnDB(start, end, e.rule); err != nil {
+		log.Println("Failed to detect missed shifts: ", err)
+		return
+	}
+
+	missed, err := accessdb.GetUnnotifiedMissedShiftsFromDB()
+	if err != nil {
+		log.Println("Failed to get missed shifts: ", err)
+		return
+	}
+	var missedIds []uint
+	for _, m := range missed {
+		missedIds = append(missedIds, m.ID)
+	}
+	logs, err := accessdb.GetEscalationLogsFromDB(missedIds)
+	if err != nil {
+		log.Println("Failed to get escalation logs: ", err)
+		return
+	}
+	sent := make(map[sentKey]bool)
+	for _, l := range logs {
+		sent[sentKey{l.MissedShiftID, l.Recipient, l.Channel}] = true
+	}
+
+	for _, m := range missed {
+		if m.StudentNotifiedAt == 0 && e.send(ctx, m.ID, StudentMessage(m), sent) {
+			if err := accessdb.MarkMissedShiftNotifiedOnDB(m.ID, "student", time.Now().Unix()); err != nil {
+				log.Println("Failed to record notification: ", err)
+			}
+		}
+		if m.Escalated && m.StaffNotifiedAt == 0 && len(e.staff) > 0 {
+			allSent := true
+			for _, login := range e.staff {
+				allSent = e.send(ctx, m.ID, StaffMessage(m, login), sent) && allSent
+			}
+			if allSent {
+				if err := accessdb.MarkMissedShiftNotifiedOnDB(m.ID, "staff", time.Now().Unix()); err != nil {
+					log.Println("Failed to record notification: ", err)
+				}
+			}
+		}
+	}
+}
+
+type sentKey struct {
+	missedId  uint
+	recipient string
+	channel   string
+}
+
+/*
+Sends the message about the miss through every notifier that has not sent it yet, records each one that accepted it,
+and returns whether all of them have.
+*/
+func (e *Escalator) send(ctx context.Context, missedId uint, message notify.Message, sent map[sentKey]bool) bool {
+	allSent := true
+	for _, n := range e.notifiers {
+		key := sentKey{missedId, message.Login, n.Name()}
+		if sent[key] {
+			continue
+		}
+		if err := n.Notify(ctx, message); err != nil {
+			log.Printf("Failed to notify %s through %s: %v\n", message.Login, n.Name(), err)
+			allSent = false
+			continue
+		}
+		sent[key] = true
+		escalationLog := accessdb.EscalationLog{MissedShiftID: missedId, Recipient: message.Login, Channel: n.Name(), SentAt: time.Now().Unix()}
+		if err := accessdb.AddEscalationLogToDB(escalationLog); err != nil {
+			log.Println("Failed to record escalation: ", err)
+		}
+	}
+	return allSent
+}
+
+// Returns the message telling the student about the missed shift.
+func StudentMessage(m accessdb.MissedShift) notify.Message {
+	body := fmt.Sprintf("You did not attend your shift on %s.", m.Date)
+	if m.Penalty > 0 {
+		body += fmt.Sprintf(" %d points were deducted.", m.Penalty)
+	}
+	body += " Please contact staff if you think this is a mistake."
+	return notify.Message{Login: m.User.Login, Subject: "Missed shift", Body: body}
+}
+
+// Returns the message telling a staff member that the student has missed too many shifts.
+func StaffMessage(m accessdb.MissedShift, staffLogin string) notify.Message {
+	return notify.Message{
+		Login:   staffLogin,
+		Subject: "Missed shifts of " + m.User.Login,
+		Body:    fmt.Sprintf("%s has %d outstanding missed shifts, the last on %s.", m.User.Login, m.Misses, m.Date),
+	}
+}
@@ -0,0 +1,111 @@
+package events
+
+import (
+	"sync"
+)
+
+// Events a subscriber can fall behind by before it is dropped.
+const subscriberBuffer = 64
+
+type Event struct {
+	ID        int64
+	Type      string
+	Data      interface{}
+	CreatedAt int64
+}
+
+/*
+An in-process pub/sub of the events of the API. The latest events are kept,
+so that a subscriber that reconnects can resume from the last event it received.
+*/
+type Bus struct {
+	mu          sync.Mutex
+	history     []Event
+	size        int
+	subscribers map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	C   <-chan Event
+	c   chan Event
+	bus *Bus
+}
+
+// The bus shared by the publishers and subscribers in the process.
+var Default = NewBus(1000)
+
+// Returns a bus that keeps the given number of latest events.
+func NewBus(size int) *Bus {
+	return &Bus{size: size, subscribers: make(map[*Subscription]struct{})}
+}
+
+/*
+Publishes the event relayed from the outbox to every subscriber. The event keeps the ID of the outbox,
+so that subscribers and webhooks see the same ID, and it stays the same across restarts.
+A subscriber whose buffer is full is closed instead of blocking the publisher.
+*/
+func (b *Bus) PublishEvent(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publish(event)
+}
+
+func (b *Bus) publish(event Event) {
+	b.history = append(b.history, event)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+	for s := range b.subscribers {
+		select {
+		case s.c <- event:
+		default:
+			delete(b.subscribers, s)
+			close(s.c)
+		}
+	}
+}
+
+/*
+Subscribes to the events published from now on, and returns with it the kept events after lastID.
+A lastID of 0 replays nothing.
+*/
+func (b *Bus) Subscribe(lastID int64) (*Subscription, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []Event
+	if lastID > 0 {
+		for _, e := range b.history {
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		}
+	}
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: c, c: c, bus: b}
+	b.subscribers[s] = struct{}{}
+	return s, missed
+}
+
+/*
+Closes the channels of every subscriber, as when one falls behind, so that streams end and their clients
+reconnect and resume elsewhere. Used when the API shuts down.
+*/
+func (b *Bus) CloseSubscriptions() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		delete(b.subscribers, s)
+		close(s.c)
+	}
+}
+
+// Stops receiving events and closes the channel.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.c)
+	}
+}
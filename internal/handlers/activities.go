@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/now"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
@@ -30,6 +31,16 @@ func GetActivityCleanData(c *gin.Context) {
 	c.JSON(http.StatusOK, Activities)
 }
 
+// Handles the endpoint that gets the taps of cards that are not registered yet.
+func GetPendingTapData(c *gin.Context) {
+	pendingTaps, err := accessdb.GetPendingTapsFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get pending taps"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pending_taps": pendingTaps})
+}
+
 // Handles the endpoint that adds an activity.
 func AddActivity(c *gin.Context) {
 	var requestData ActivityRequestData
@@ -43,17 +54,46 @@ func AddActivity(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "All parameters are required"})
 		return
 	}
+	if !authorizeM5Stick(c, requestData.Mac) {
+		return
+	}
 
-	status, uid, mac, err := accessdb.AddActivityToDB(requestData.Uid, requestData.Mac)
+	status, feedback, err := accessdb.AddActivityToDB(requestData.Uid, requestData.Mac)
+	if err != nil && feedback != nil {
+		// The card is not registered, so lead the student to the registration.
+		registrationURL := requestBaseURL(c) + "/new?uid=" + url.QueryEscape(feedback.Uid)
+		if feedback.Message == "" {
+			feedback.Message = "Scan the QR code to register your card"
+		}
+		c.JSON(status, gin.H{
+			"error":            err.Error(),
+			"uid":              feedback.Uid,
+			"mac":              feedback.Mac,
+			"message":          feedback.Message,
+			"registration_url": registrationURL,
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
+	if feedback.Message == "" {
+		feedback.Message = defaultTapMessage(feedback)
+	}
 
-	c.JSON(status, gin.H{"uid": uid, "mac": mac})
+	c.JSON(status, feedback)
 	return
 }
 
+// Return the message shown for a tap on a M5stick without a configured message.
+func defaultTapMessage(feedback *accessdb.TapFeedback) string {
+	if feedback.Session == "opened" {
+		return "Hello, " + feedback.Login + "!"
+	}
+	return "Thanks, " + feedback.Login + "!"
+}
+
 /*
 Determine start_time and end_time from the query.
 If there is no start parameter, the start_time will be 00:00:00 on the execution date.
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+// Routes the M5sticks call on every tap and heartbeat, which are too frequent to be worth auditing.
+var unauditedRoutes = map[string]bool{
+	"POST /activities":              true,
+	"POST /m5sticks/:mac/heartbeat": true,
+}
+
+/*
+Gives every request an ID, taken from the X-Request-ID header or generated, and returns it in the same header.
+After a POST, PUT, PATCH, or DELETE, the request is written to the audit log with its status,
+so that attempts that changed nothing are on record as well.
+*/
+func AuditRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" || len(requestID) > 64 {
+			requestID = newRequestID()
+		}
+		c.Set(requestIDKey, requestID)
+		c.Header("X-Request-ID", requestID)
+
+		c.Next()
+
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			return
+		}
+		action := c.Request.Method + " " + c.FullPath()
+		if c.FullPath() == "" || unauditedRoutes[action] {
+			return
+		}
+		if err := accessdb.AddRequestAuditLogToDB(requestAudit(c), action, c.Request.URL.Path, c.Writer.Status()); err != nil {
+			log.Println("Failed to write the audit log: ", err)
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// The most entries of the audit log returned at once.
+const maxAuditLimit = 1000
+
+/*
+Handles the endpoint that gets the audit log, newest first. The entries can be narrowed by entity_type and entity_id,
+such as user and a login or shift and an ID, and by request_id. start and end are unix time, and default to today.
+*/
+func GetAuditLogs(c *gin.Context) {
+	start, end, err := GetQueryAboutTime(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range"})
+		return
+	}
+	limit, err := getQueryInt(c, "limit", 100)
+	if err != nil || limit < 1 || limit > maxAuditLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	entries, err := accessdb.GetAuditLogsFromDB(c.Query("entity_type"), c.Query("entity_id"), c.Query("request_id"), start, end, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/icalendar"
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Shifts older than this are left out of the calendar feeds.
+const calendarPastDays = 30
+
+// Handle the endpoint that returns the secret calendar URL of the authenticated user.
+func GetCalendarURL(c *gin.Context) {
+	handleCalendarToken(c, false)
+}
+
+// Handle the endpoint that reissues the secret calendar URL of the authenticated user.
+func ResetCalendarURL(c *gin.Context) {
+	handleCalendarToken(c, true)
+}
+
+func handleCalendarToken(c *gin.Context, reset bool) {
+	login, err := authenticatedLogin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	token, err := accessdb.GetCalendarTokenFromDB(login, reset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"login": login, "url": requestBaseURL(c) + "/calendar/users/" + token + ".ics"})
+}
+
+// Handle the endpoint that returns the calendar feed of a user's shifts.
+func GetUserCalendar(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+	user, err := accessdb.GetUserByCalendarTokenFromDB(token)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get calendar"})
+		}
+		return
+	}
+	shifts, err := accessdb.GetCalendarShiftsFromDB(&user.ID, calendarStartDate())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shifts"})
+		return
+	}
+	writeCalendar(c, "Shifts of "+user.Login, shifts, false)
+}
+
+/*
+Handle the endpoint that returns the calendar feed of all shifts, optionally narrowed to a location.
+The feed is served only under the secret CALENDAR_CAMPUS_TOKEN, and is closed while it is not set.
+*/
+func GetCampusCalendar(c *gin.Context) {
+	expected := os.Getenv("CALENDAR_CAMPUS_TOKEN")
+	if expected == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Campus calendar token is not configured"})
+		return
+	}
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+		return
+	}
+	shifts, err := accessdb.GetCalendarShiftsFromDB(nil, calendarStartDate())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shifts"})
+		return
+	}
+	name := "Shifts"
+	if location := c.Query("location"); location != "" {
+		var filtered []accessdb.Shift
+		for _, s := range shifts {
+			if s.Slot != nil && s.Slot.Location != nil && s.Slot.Location.Name == location {
+				filtered = append(filtered, s)
+			}
+		}
+		shifts = filtered
+		name += " at " + location
+	}
+	writeCalendar(c, name, shifts, true)
+}
+
+func calendarStartDate() string {
+	return time.Now().AddDate(0, 0, -calendarPastDays).Format("2006-01-02")
+}
+
+func writeCalendar(c *gin.Context, name string, shifts []accessdb.Shift, withLogin bool) {
+	var events []icalendar.Event
+	for _, s := range shifts {
+		event, err := shiftToEvent(s, withLogin)
+		if err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(icalendar.Build(name, events, time.Now())))
+}
+
+/*
+Convert a shift to a calendar event.
+A shift in a slot with a start time becomes a timed event, and any other shift an all-day event.
+*/
+func shiftToEvent(s accessdb.Shift, withLogin bool) (icalendar.Event, error) {
+	event := icalendar.Event{
+		UID:       fmt.Sprintf("shift-%d@42activityapi", s.ID),
+		Summary:   "Shift",
+		Cancelled: s.DeletedAt.Valid,
+		Sequence:  s.Revision,
+	}
+	date, err := time.ParseInLocation("2006-01-02", s.Date, time.Local)
+	if err != nil {
+		return event, err
+	}
+	event.Start, event.End, event.AllDay = date, date.AddDate(0, 0, 1), true
+
+	if s.Slot != nil {
+		if s.Slot.Role != nil {
+			event.Summary = s.Slot.Role.Name
+		}
+		if s.Slot.Location != nil {
+			event.Location = s.Slot.Location.Name
+		}
+		if s.Slot.StartTime != "" {
+			event.Start, err = s.Slot.StartsAt()
+			if err != nil {
+				return event, err
+			}
+			event.End, event.AllDay = event.Start.Add(time.Hour), false
+			if s.Slot.EndTime != "" {
+				event.End, err = time.ParseInLocation("2006-01-02 15:04", s.Slot.Date+" "+s.Slot.EndTime, time.Local)
+				if err != nil {
+					return event, err
+				}
+			}
+		}
+	}
+	if withLogin {
+		event.Summary = s.User.Login + ": " + event.Summary
+	}
+	return event, nil
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/loadconfig"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+Release channels of firmwares, each with the channels a M5stick following it accepts.
+A M5stick on beta also gets stable releases, but one on stable never gets a beta release.
+*/
+var firmwareChannels = map[string][]string{
+	"stable": {"stable"},
+	"beta":   {"stable", "beta"},
+}
+
+type FirmwareTargetRequestData struct {
+	Version string `json:"version"`
+}
+
+/*
+Handles the endpoint that adds a firmware release.
+The binary is uploaded as multipart form data with the version, channel, and optionally its SHA-256 checksum.
+*/
+func AddFirmware(c *gin.Context) {
+	version := c.PostForm("version")
+	channel := c.DefaultPostForm("channel", "stable")
+	checksum := strings.ToLower(c.PostForm("checksum"))
+	if !isVersionStringValid(version) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+	if _, ok := firmwareChannels[channel]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel"})
+		return
+	}
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+
+	tmpPath, sum, size, err := saveUploadedFile(fileHeader)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save firmware"})
+		return
+	}
+	defer os.Remove(tmpPath)
+	if checksum != "" && checksum != sum {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum does not match"})
+		return
+	}
+
+	// The row is added first so that the binary of an existing version is never overwritten,
+	// and removed again if the binary cannot be moved into place.
+	path := filepath.Join(firmwareDir(), "firmware-"+version+".bin")
+	firmware, err := accessdb.AddFirmwareToDB(accessdb.Firmware{Version: version, Channel: channel, Checksum: sum, Size: size, Path: path})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		if err := accessdb.DeleteFirmwareFromDB(firmware.ID); err != nil {
+			log.Println("Failed to delete the firmware without a binary: ", err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save firmware"})
+		return
+	}
+	c.JSON(http.StatusOK, firmware)
+}
+
+// Handles the endpoint that gets the firmware releases.
+func GetFirmwares(c *gin.Context) {
+	if channel := c.Query("channel"); channel != "" {
+		if _, ok := firmwareChannels[channel]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel"})
+			return
+		}
+	}
+	firmwares, err := accessdb.GetFirmwaresFromDB(c.Query("channel"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get firmwares"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"firmwares": firmwares})
+}
+
+// Handles the endpoint that downloads the binary of a firmware release.
+func DownloadFirmware(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid firmware id"})
+		return
+	}
+	firmware, err := accessdb.GetFirmwareFromDB(uint(id))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Firmware not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get firmware"})
+		}
+		return
+	}
+	c.Header("X-Checksum-SHA256", firmware.Checksum)
+	c.FileAttachment(firmware.Path, "firmware-"+firmware.Version+".bin")
+}
+
+// Handles the endpoint that sets the target firmware of the M5stick.
+func SetM5StickFirmware(c *gin.Context) {
+	handleFirmwareTarget(c, c.Param("mac"), accessdb.SetM5StickFirmwareOnDB)
+}
+
+// Handles the endpoint that sets the target firmware of the role.
+func SetRoleFirmware(c *gin.Context) {
+	handleFirmwareTarget(c, c.Param("name"), accessdb.SetRoleFirmwareOnDB)
+}
+
+func handleFirmwareTarget(c *gin.Context, target string, setFirmware func(string, string) error) {
+	var requestData FirmwareTargetRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := setFirmware(target, requestData.Version); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set firmware"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"target": target, "version": requestData.Version})
+}
+
+/*
+Handles the endpoint where the M5stick asks whether it should update its firmware.
+The current version is taken from the current query, or from the last heartbeat if it is not given.
+The channel query is the channel the M5stick follows, stable by default, and a target outside it is not offered.
+*/
+func CheckFirmwareUpdate(c *gin.Context) {
+	mac := c.Param("mac")
+	if !authorizeM5Stick(c, mac) {
+		return
+	}
+	accepted, ok := firmwareChannels[c.DefaultQuery("channel", "stable")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel"})
+		return
+	}
+	m5Stick, firmware, err := accessdb.GetTargetFirmwareFromDB(mac)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get firmware"})
+		return
+	}
+	current := c.DefaultQuery("current", m5Stick.FirmwareVersion)
+	if firmware == nil || firmware.Version == current || !slices.Contains(accepted, firmware.Channel) {
+		c.JSON(http.StatusOK, gin.H{"update": false, "current": current})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"update":   true,
+		"current":  current,
+		"version":  firmware.Version,
+		"url":      fmt.Sprintf("%s/firmwares/%d/download", requestBaseURL(c), firmware.ID),
+		"checksum": firmware.Checksum,
+		"size":     firmware.Size,
+	})
+}
+
+func isVersionStringValid(version string) bool {
+	return regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._-]{0,31}$`).MatchString(version)
+}
+
+func firmwareDir() string {
+	return loadconfig.GetEnv("FIRMWARE_DIR", "firmware")
+}
+
+// Save the uploaded binary to a temporary file under FIRMWARE_DIR, and return its path, SHA-256 checksum and size.
+func saveUploadedFile(fileHeader *multipart.FileHeader) (string, string, int64, error) {
+	if err := os.MkdirAll(firmwareDir(), 0755); err != nil {
+		return "", "", 0, err
+	}
+	src, err := fileHeader.Open()
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(firmwareDir(), "upload-*")
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer dst.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", "", 0, err
+	}
+	return dst.Name(), hex.EncodeToString(hash.Sum(nil)), size, nil
+}
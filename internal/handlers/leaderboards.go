@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/leaderboard"
+	"context"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+type LeaderboardOptOutRequestData struct {
+	OptOut bool `json:"opt_out"`
+}
+
+var leaderboards = leaderboard.NewCache(func(key leaderboard.Key, start int64, end int64) ([]accessdb.LeaderboardEntry, error) {
+	return accessdb.GetLeaderboardFromDB(key.Role, start, end, key.Metric)
+})
+
+/*
+Handles the endpoint that gets the leaderboard of a role for a period.
+The leaderboard is served from the cache, which is refreshed in the background.
+*/
+func GetLeaderboard(c *gin.Context) {
+	key := leaderboard.Key{
+		Role:   c.Query("role"),
+		Period: c.DefaultQuery("period", "month"),
+		Metric: c.DefaultQuery("metric", "count"),
+	}
+	if key.Metric != "count" && key.Metric != "duration" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "metric must be count or duration"})
+		return
+	}
+	if _, _, err := leaderboard.PeriodRange(key.Period, time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := getQueryInt(c, "limit", 10)
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+		return
+	}
+	// Only leaderboards of existing roles are cached, so that made up roles cannot grow the cache.
+	if key.Role != "" {
+		if _, err := accessdb.GetRoleFromDB(key.Role); err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get leaderboard"})
+			}
+			return
+		}
+	}
+
+	board, err := leaderboards.Get(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get leaderboard"})
+		return
+	}
+	response := *board
+	if len(response.Entries) > limit {
+		response.Entries = response.Entries[:limit]
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Handles the endpoint where the authenticated user opts out of or back into the leaderboards.
+func SetLeaderboardOptOut(c *gin.Context) {
+	var requestData LeaderboardOptOutRequestData
+
+	login, err := authenticatedLogin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := accessdb.SetLeaderboardOptOutOnDB(login, requestData.OptOut); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		}
+		return
+	}
+	leaderboards.Invalidate()
+	c.JSON(http.StatusOK, gin.H{"login": login, "opt_out": requestData.OptOut})
+}
+
+// Refreshes the cached leaderboards at the interval until the context is done.
+func RunLeaderboardRefresher(ctx context.Context, interval time.Duration) {
+	leaderboards.Run(ctx, interval)
+}
@@ -2,8 +2,18 @@ package handlers
 
 import (
 	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/loadconfig"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type M5StickRequestData struct {
@@ -12,6 +22,50 @@ type M5StickRequestData struct {
 	LocationName string `json:"location"`
 }
 
+type EnrollmentCodeRequestData struct {
+	RoleName     string `json:"role"`
+	LocationName string `json:"location"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type EnrollRequestData struct {
+	Mac  string `json:"mac"`
+	Code string `json:"code"`
+}
+
+type M5StickHealth struct {
+	Mac             string `json:"mac"`
+	Role            string `json:"role"`
+	LastSeen        int64  `json:"last_seen"`
+	FirmwareVersion string `json:"firmware_version"`
+	Battery         *int   `json:"battery"`
+	Rssi            int    `json:"rssi"`
+	Offline         bool   `json:"offline"`
+	LowBattery      bool   `json:"low_battery"`
+}
+
+type LocationHealth struct {
+	Location string          `json:"location"`
+	M5Sticks []M5StickHealth `json:"m5sticks"`
+}
+
+type DeviceConfigRequestData struct {
+	Messages    accessdb.DisplayMessages `json:"messages"`
+	TapCooldown int                      `json:"tap_cooldown"`
+}
+
+type DeviceConfigResponse struct {
+	accessdb.DeviceConfig
+	ServerTime int64 `json:"server_time"`
+}
+
+// Messages shown by a M5stick unless they are configured for it.
+var defaultDisplayMessages = accessdb.DisplayMessages{
+	Idle:    "Touch your card",
+	Success: "Thank you!",
+	Error:   "Try again",
+}
+
 // Handles the endpoint to add the M5stick.
 func AddM5Stick(c *gin.Context) {
 	var requestData M5StickRequestData
@@ -31,3 +85,316 @@ func AddM5Stick(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"mac": requestData.Mac, "role": requestData.RoleName, "location": requestData.LocationName})
 	return
 }
+
+// Handles the endpoint that issues an enrollment code for the role and location.
+func AddEnrollmentCode(c *gin.Context) {
+	var requestData EnrollmentCodeRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestData.RoleName == "" || requestData.LocationName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role and location are required"})
+		return
+	}
+	if requestData.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must not be negative"})
+		return
+	}
+	if requestData.ExpiresIn == 0 {
+		requestData.ExpiresIn = 24 * 60 * 60
+	}
+	expiresAt := time.Now().Unix() + requestData.ExpiresIn
+	enrollmentCode, err := accessdb.AddEnrollmentCodeToDB(requestData.RoleName, requestData.LocationName, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":       enrollmentCode.Code,
+		"role":       enrollmentCode.Role.Name,
+		"location":   enrollmentCode.Location.Name,
+		"expires_at": enrollmentCode.ExpiresAt,
+	})
+}
+
+// Handles the endpoint where an unregistered M5stick registers itself with an enrollment code.
+func EnrollM5Stick(c *gin.Context) {
+	var requestData EnrollRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestData.Mac == "" || requestData.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "All parameters are required"})
+		return
+	}
+	status, m5Stick, token, err := accessdb.EnrollM5StickOnDB(requestData.Mac, strings.ToUpper(requestData.Code))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, gin.H{"mac": m5Stick.Mac, "role": m5Stick.Role.Name, "location": m5Stick.Location.Name, "token": token})
+}
+
+/*
+Check that the request carries the token of the M5stick as the Bearer token.
+If it does not, the error response is written and false is returned.
+*/
+func authorizeM5Stick(c *gin.Context, mac string) bool {
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if status, err := accessdb.VerifyM5StickToken(mac, token); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// Handles the endpoint where the M5stick reports its state.
+func RecordHeartbeat(c *gin.Context) {
+	var requestData accessdb.Heartbeat
+
+	if !authorizeM5Stick(c, c.Param("mac")) {
+		return
+	}
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestData.Battery != nil && (*requestData.Battery < 0 || *requestData.Battery > 100) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Battery must be between 0 and 100"})
+		return
+	}
+	m5Stick, err := accessdb.RecordHeartbeatOnDB(c.Param("mac"), requestData)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "M5Stick not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record heartbeat"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mac": m5Stick.Mac, "server_time": time.Now().Unix()})
+}
+
+/*
+Handles the endpoint that lists the M5sticks that are offline or low on battery, grouped by location.
+The thresholds can be given by the offline_after (seconds) and low_battery (percent) queries.
+*/
+func GetM5StickHealth(c *gin.Context) {
+	offlineAfter, err := getQueryInt(c, "offline_after", loadconfig.GetEnvInt("M5STICK_OFFLINE_SECONDS", 300))
+	if err != nil || offlineAfter <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query"})
+		return
+	}
+	lowBattery, err := getQueryInt(c, "low_battery", loadconfig.GetEnvInt("M5STICK_LOW_BATTERY", 20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query"})
+		return
+	}
+
+	offlineBefore := time.Now().Unix() - int64(offlineAfter)
+	m5Sticks, err := accessdb.GetUnhealthyM5SticksFromDB(offlineBefore, lowBattery, c.Query("location"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get M5Sticks"})
+		return
+	}
+
+	locations := []LocationHealth{}
+	for _, m := range m5Sticks {
+		if len(locations) == 0 || locations[len(locations)-1].Location != m.Location.Name {
+			locations = append(locations, LocationHealth{Location: m.Location.Name})
+		}
+		l := &locations[len(locations)-1]
+		l.M5Sticks = append(l.M5Sticks, M5StickHealth{
+			Mac:             m.Mac,
+			Role:            m.Role.Name,
+			LastSeen:        m.LastSeen,
+			FirmwareVersion: m.FirmwareVersion,
+			Battery:         m.Battery,
+			Rssi:            m.Rssi,
+			Offline:         m.LastSeen < offlineBefore,
+			LowBattery:      m.Battery != nil && *m.Battery <= lowBattery,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"locations": locations})
+}
+
+// Get an integer query, or the default value if the query is not given.
+func getQueryInt(c *gin.Context, key string, fallback int) (int, error) {
+	value := c.Query(key)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+/*
+Handles the endpoint where the M5stick gets its configuration.
+The response has an ETag, and 304 Not Modified is returned while the configuration is unchanged,
+so that the M5stick can poll it cheaply.
+*/
+func GetM5StickConfig(c *gin.Context) {
+	if !authorizeM5Stick(c, c.Param("mac")) {
+		return
+	}
+	config, etag, ok := loadM5StickConfig(c)
+	if !ok {
+		return
+	}
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, DeviceConfigResponse{DeviceConfig: *config, ServerTime: time.Now().Unix()})
+}
+
+// Handles the endpoint that updates the configuration of the M5stick.
+func UpdateM5StickConfig(c *gin.Context) {
+	var requestData DeviceConfigRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestData.TapCooldown < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tap_cooldown must not be negative"})
+		return
+	}
+	if err := accessdb.UpdateM5StickConfigOnDB(c.Param("mac"), requestData.Messages, requestData.TapCooldown); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "M5Stick not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update config"})
+		}
+		return
+	}
+	config, _, ok := loadM5StickConfig(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, DeviceConfigResponse{DeviceConfig: *config, ServerTime: time.Now().Unix()})
+}
+
+/*
+Get the configuration of the M5stick in the path with the defaults applied, and set its ETag header.
+If it fails, the error response is written and ok is false.
+*/
+func loadM5StickConfig(c *gin.Context) (*accessdb.DeviceConfig, string, bool) {
+	config, err := accessdb.GetM5StickConfigFromDB(c.Param("mac"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "M5Stick not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get config"})
+		}
+		return nil, "", false
+	}
+	applyDefaultConfig(config)
+
+	etag, err := configETag(config)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get config"})
+		return nil, "", false
+	}
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	return config, etag, true
+}
+
+// Fill the values that are not configured for the M5stick with the defaults.
+func applyDefaultConfig(config *accessdb.DeviceConfig) {
+	if config.Messages.Idle == "" {
+		config.Messages.Idle = defaultDisplayMessages.Idle
+	}
+	if config.Messages.Success == "" {
+		config.Messages.Success = defaultDisplayMessages.Success
+	}
+	if config.Messages.Error == "" {
+		config.Messages.Error = defaultDisplayMessages.Error
+	}
+	if config.TapCooldown == 0 {
+		config.TapCooldown = loadconfig.GetEnvInt("M5STICK_TAP_COOLDOWN", 3)
+	}
+}
+
+// Return a strong ETag of the configuration. The server time is not part of it.
+func configETag(config *accessdb.DeviceConfig) (string, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// Report whether the If-None-Match header contains the ETag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// A M5stick going offline or coming back, as published to the event bus.
+type DeviceEvent struct {
+	Mac      string `json:"mac"`
+	Role     string `json:"role"`
+	Location string `json:"location"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+/*
+Checks the heartbeats of the M5sticks at the interval until the context is done,
+and writes "device.offline" to the outbox when a M5stick stops sending them and "device.online" when it is back.
+M5sticks that have never sent a heartbeat are not watched.
+*/
+func RunDeviceMonitor(ctx context.Context, interval time.Duration) {
+	var offline map[string]DeviceEvent
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		offlineBefore := time.Now().Unix() - int64(loadconfig.GetEnvInt("M5STICK_OFFLINE_SECONDS", 300))
+		m5Sticks, err := accessdb.GetUnhealthyM5SticksFromDB(offlineBefore, -1, "")
+		if err != nil {
+			log.Println("Failed to get M5Sticks: ", err)
+			continue
+		}
+		current := make(map[string]DeviceEvent)
+		for _, m := range m5Sticks {
+			if m.LastSeen > 0 && m.LastSeen < offlineBefore {
+				current[m.Mac] = DeviceEvent{Mac: m.Mac, Role: m.Role.Name, Location: m.Location.Name, LastSeen: m.LastSeen}
+			}
+		}
+		// The first check only learns which M5sticks are already offline.
+		if offline != nil {
+			for mac, e := range current {
+				if _, ok := offline[mac]; !ok {
+					if err := accessdb.AddOutboxEventToDB("device.offline", e); err != nil {
+						log.Println("Failed to add device event: ", err)
+					}
+				}
+			}
+			for mac, e := range offline {
+				if _, ok := current[mac]; !ok {
+					if err := accessdb.AddOutboxEventToDB("device.online", e); err != nil {
+						log.Println("Failed to add device event: ", err)
+					}
+				}
+			}
+		}
+		offline = current
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/escalation"
+	"42ActivityAPI/internal/loadconfig"
+	"42ActivityAPI/internal/notify"
+	"context"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MissedShiftCheckRequestData struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type ResolveMissedShiftRequestData struct {
+	Note   string `json:"note"`
+	Refund bool   `json:"refund"`
+}
+
+// The outstanding misses of a student.
+type OutstandingMisses struct {
+	Login  string                 `json:"login"`
+	Misses int                    `json:"misses"`
+	Shifts []accessdb.MissedShift `json:"shifts"`
+}
+
+// Handles the endpoint that lists the students with outstanding missed shifts, most misses first.
+func GetMissedShifts(c *gin.Context) {
+	missed, err := accessdb.GetOutstandingMissedShiftsFromDB(c.Query("login"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get missed shifts"})
+		}
+		return
+	}
+	students := []OutstandingMisses{}
+	indexOfLogin := make(map[string]int)
+	for _, m := range missed {
+		i, ok := indexOfLogin[m.User.Login]
+		if !ok {
+			i = len(students)
+			indexOfLogin[m.User.Login] = i
+			students = append(students, OutstandingMisses{Login: m.User.Login})
+		}
+		students[i].Misses++
+		students[i].Shifts = append(students[i].Shifts, m)
+	}
+	sort.SliceStable(students, func(i, j int) bool {
+		if students[i].Misses != students[j].Misses {
+			return students[i].Misses > students[j].Misses
+		}
+		return students[i].Login < students[j].Login
+	})
+	c.JSON(http.StatusOK, gin.H{"students": students})
+}
+
+// Handles the endpoint that finds the missed shifts in a date range that is over, and escalates them.
+func CheckMissedShifts(c *gin.Context) {
+	var requestData MissedShiftCheckRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !isDateStringValid(requestData.Start) || !isDateStringValid(requestData.End) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. It should be in YYYY-MM-DD format"})
+		return
+	}
+	if requestData.Start > requestData.End {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range"})
+		return
+	}
+	if requestData.End >= time.Now().Format("2006-01-02") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "End must be before today"})
+		return
+	}
+	missed, err := accessdb.DetectMissedShiftsOnDB(requestData.Start, requestData.End, missRule())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if missed == nil {
+		missed = []accessdb.MissedShift{}
+	}
+	c.JSON(http.StatusOK, gin.H{"missed": missed})
+}
+
+// Handles the endpoint where staff resolve a missed shift, optionally refunding the penalty.
+func ResolveMissedShift(c *gin.Context) {
+	var requestData ResolveMissedShiftRequestData
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid missed shift id"})
+		return
+	}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status, missed, err := accessdb.ResolveMissedShiftOnDB(uint(id), requestActor(c), requestData.Note, requestData.Refund)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, missed)
+}
+
+/*
+Finds the shifts missed in the last MISSED_SHIFT_LOOKBACK_DAYS at the interval until the context is done,
+and notifies the students and, once escalated, the staff in MISSED_SHIFT_STAFF_LOGINS through NOTIFY_CHANNELS.
+*/
+func RunMissedShiftEscalator(ctx context.Context, interval time.Duration) {
+	notifiers, err := notify.FromEnv()
+	if err != nil {
+		log.Println("Missed shift escalation is disabled: ", err)
+		return
+	}
+	var staff []string
+	for _, login := range strings.Split(loadconfig.GetEnv("MISSED_SHIFT_STAFF_LOGINS", ""), ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			staff = append(staff, login)
+		}
+	}
+	escalation.NewEscalator(notifiers, staff, missRule(), loadconfig.GetEnvInt("MISSED_SHIFT_LOOKBACK_DAYS", 7)).Run(ctx, interval)
+}
+
+// The escalation rule from MISSED_SHIFT_PENALTY, MISSED_SHIFT_STAFF_THRESHOLD, and MISSED_SHIFT_PERIOD_DAYS.
+func missRule() accessdb.MissRule {
+	return accessdb.MissRule{
+		PenaltyPoints:  loadconfig.GetEnvInt("MISSED_SHIFT_PENALTY", 0),
+		StaffThreshold: loadconfig.GetEnvInt("MISSED_SHIFT_STAFF_THRESHOLD", 3),
+		PeriodDays:     loadconfig.GetEnvInt("MISSED_SHIFT_PERIOD_DAYS", 30),
+	}
+}
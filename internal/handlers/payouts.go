@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/loadconfig"
+	"encoding/csv"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+type PayoutBatchRequestData struct {
+	End string `json:"end"`
+}
+
+type PayoutPaidRequestData struct {
+	TxHash string `json:"tx_hash"`
+}
+
+/*
+Handle the endpoint that adds a draft payout batch for the points not yet paid by the end of a period.
+The period runs from the day after the last batch to end, so only end is given.
+*/
+func AddPayoutBatch(c *gin.Context) {
+	var requestData PayoutBatchRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !isDateStringValid(requestData.End) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. It should be in YYYY-MM-DD format"})
+		return
+	}
+	status, batch, err := accessdb.AddPayoutBatchToDB(requestData.End, tokensPerPoint(), requestActor(c))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, batch)
+}
+
+// Handle the endpoint that gets the payout batches.
+func GetPayoutBatches(c *gin.Context) {
+	batches, err := accessdb.GetPayoutBatchesFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get payout batches"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"batches": batches})
+}
+
+// Handle the endpoint that gets a payout batch with its items.
+func GetPayoutBatch(c *gin.Context) {
+	batch, ok := loadPayoutBatch(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, batch)
+}
+
+// Handle the endpoint that calculates the items of a draft payout batch again.
+func RecalculatePayoutBatch(c *gin.Context) {
+	handlePayoutBatchChange(c, func(id uint) (int, *accessdb.PayoutBatch, error) {
+		return accessdb.RecalculatePayoutBatchOnDB(id, tokensPerPoint())
+	})
+}
+
+// Handle the endpoint that approves a draft payout batch, after which it cannot be changed.
+func ApprovePayoutBatch(c *gin.Context) {
+	handlePayoutBatchChange(c, func(id uint) (int, *accessdb.PayoutBatch, error) {
+		return accessdb.ApprovePayoutBatchOnDB(id, requestActor(c))
+	})
+}
+
+// Handle the endpoint that marks an approved payout batch as paid.
+func MarkPayoutBatchPaid(c *gin.Context) {
+	var requestData PayoutPaidRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !regexp.MustCompile(`^0x[0-9a-fA-F]{64}$`).MatchString(requestData.TxHash) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction hash"})
+		return
+	}
+	handlePayoutBatchChange(c, func(id uint) (int, *accessdb.PayoutBatch, error) {
+		return accessdb.MarkPayoutBatchPaidOnDB(id, requestData.TxHash)
+	})
+}
+
+// Handle the endpoint that deletes a draft payout batch.
+func DeletePayoutBatch(c *gin.Context) {
+	handlePayoutBatchChange(c, func(id uint) (int, *accessdb.PayoutBatch, error) {
+		status, err := accessdb.DeletePayoutBatchFromDB(id)
+		return status, nil, err
+	})
+}
+
+/*
+Handle the endpoint that exports the recipients of an approved or paid payout batch.
+The format query is csv, with lines of address and amount as multisend tools take them, or json.
+*/
+func ExportPayoutBatch(c *gin.Context) {
+	batch, ok := loadPayoutBatch(c)
+	if !ok {
+		return
+	}
+	if batch.Status == "draft" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Payout batch is not approved"})
+		return
+	}
+	recipients := accessdb.PayoutRecipients(batch.Items)
+
+	switch c.DefaultQuery("format", "csv") {
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=payout-%d.csv", batch.ID))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		for _, r := range recipients {
+			w.Write([]string{r.Address, strconv.FormatInt(r.Amount, 10)})
+		}
+		w.Flush()
+	case "json":
+		var total int64
+		for _, r := range recipients {
+			total += r.Amount
+		}
+		c.JSON(http.StatusOK, gin.H{"batch_id": batch.ID, "status": batch.Status, "total": total, "recipients": recipients})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be csv or json"})
+	}
+}
+
+func handlePayoutBatchChange(c *gin.Context, change func(uint) (int, *accessdb.PayoutBatch, error)) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payout batch id"})
+		return
+	}
+	status, batch, err := change(uint(id))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if batch == nil {
+		c.JSON(status, gin.H{"id": id})
+		return
+	}
+	c.JSON(status, batch)
+}
+
+func loadPayoutBatch(c *gin.Context) (*accessdb.PayoutBatch, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payout batch id"})
+		return nil, false
+	}
+	batch, err := accessdb.GetPayoutBatchFromDB(uint(id))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Payout batch not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get payout batch"})
+		}
+		return nil, false
+	}
+	return batch, true
+}
+
+// Tokens paid for a point, from PAYOUT_TOKENS_PER_POINT.
+func tokensPerPoint() int64 {
+	return int64(loadconfig.GetEnvInt("PAYOUT_TOKENS_PER_POINT", 1))
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+)
+
+type PointRuleRequestData struct {
+	RoleName         string `json:"role"`
+	PointsPerSession int    `json:"per_session"`
+	PointsPerHour    int    `json:"per_hour"`
+	PointsPerShift   int    `json:"per_shift"`
+}
+
+type AccrueRequestData struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type AdjustmentRequestData struct {
+	Login  string `json:"login"`
+	Points int    `json:"points"`
+	Reason string `json:"reason"`
+}
+
+// Handle the endpoint that gets the point rules.
+func GetPointRules(c *gin.Context) {
+	rules, err := accessdb.GetPointRulesFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get point rules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// Handle the endpoint that sets the point rule of a role.
+func SetPointRule(c *gin.Context) {
+	var requestData PointRuleRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestData.RoleName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role is required"})
+		return
+	}
+	if requestData.PointsPerSession < 0 || requestData.PointsPerHour < 0 || requestData.PointsPerShift < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Points must not be negative"})
+		return
+	}
+	rule, err := accessdb.SetPointRuleOnDB(requestData.RoleName, requestData.PointsPerSession, requestData.PointsPerHour, requestData.PointsPerShift)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// Handle the endpoint that adds the points earned in a date range to the ledger.
+func AccruePoints(c *gin.Context) {
+	var requestData AccrueRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !isDateStringValid(requestData.Start) || !isDateStringValid(requestData.End) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. It should be in YYYY-MM-DD format"})
+		return
+	}
+	if requestData.Start > requestData.End {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range"})
+		return
+	}
+	added, err := accessdb.AccruePointsOnDB(requestData.Start, requestData.End)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+// Handle the endpoint that gets the point balances of all users.
+func GetBalances(c *gin.Context) {
+	balances, err := accessdb.GetBalancesFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get balances"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"balances": balances})
+}
+
+// Handle the endpoint that gets the point balance and ledger entries of a user.
+func GetUserPoints(c *gin.Context) {
+	balance, entries, err := accessdb.GetUserPointsFromDB(c.Param("login"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get points"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"login": balance.Login, "balance": balance.Balance, "entries": entries})
+}
+
+// Handle the endpoint that adjusts the points of a user.
+func AddPointAdjustment(c *gin.Context) {
+	var requestData AdjustmentRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestData.Login == "" || requestData.Points == 0 || requestData.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "login, points and reason are required"})
+		return
+	}
+	entry, err := accessdb.AddPointAdjustmentToDB(requestData.Login, requestData.Points, requestData.Reason, requestActor(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
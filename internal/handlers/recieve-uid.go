@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 type TokenProperty struct {
@@ -50,13 +51,15 @@ func HandleUIDSubmission(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get user infomation"})
 		return
 	}
+	// The student registers the card themselves, so they are the actor of the change.
+	c.Set(actorKey, intraName)
 	if accessdb.UserExists(intraName) {
-		if err := accessdb.AddUidToExistUser(intraName, requestData.Uid); err != nil {
+		if err := accessdb.AddUidToExistUser(intraName, requestData.Uid, requestAudit(c)); err != nil {
 			c.JSON(http.StatusConflict, gin.H{"error": "User with this login is already associated with a uid"})
 			return
 		}
 	} else {
-		if err := accessdb.AddUserToDB(requestData.Uid, intraName, ""); err != nil {
+		if err := accessdb.AddUserToDB(requestData.Uid, intraName, "", requestAudit(c)); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
@@ -153,3 +156,20 @@ func fetchUserData(accessToken string) (string, error) {
 
 	return intraName, nil
 }
+
+/*
+Receive the request carrying a 42 intra access token as the Bearer token,
+and return the intra name of its owner.
+*/
+func authenticatedLogin(c *gin.Context) (string, error) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", errors.New("Access token is required")
+	}
+	login, err := fetchUserData(token)
+	if err != nil {
+		return "", err
+	}
+	c.Set(actorKey, login)
+	return login, nil
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/loadconfig"
+	"42ActivityAPI/internal/notify"
+	"42ActivityAPI/internal/reminder"
+	"context"
+	"log"
+	"time"
+)
+
+/*
+Sends reminders of the shifts at the offsets in REMINDER_OFFSETS before them, through the channels in NOTIFY_CHANNELS,
+checking at the interval until the context is done. Whole-day shifts start at REMINDER_DAY_START.
+*/
+func RunReminderScheduler(ctx context.Context, interval time.Duration) {
+	notifiers, err := notify.FromEnv()
+	if err != nil {
+		log.Println("Shift reminders are disabled: ", err)
+		return
+	}
+	offsets, err := reminder.ParseOffsets(loadconfig.GetEnv("REMINDER_OFFSETS", "24h,1h"))
+	if err != nil {
+		log.Println("Shift reminders are disabled: ", err)
+		return
+	}
+	reminder.NewScheduler(notifiers, offsets, loadconfig.GetEnv("REMINDER_DAY_START", "09:00")).Run(ctx, interval)
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"github.com/gin-gonic/gin"
+	"os"
+	"strings"
+)
+
+/*
+Return the URL the API is served at. BASE_URL is used if it is set,
+otherwise the URL is built from the request. X-Forwarded-Proto is only honored from a proxy the router trusts,
+which is one in TRUSTED_PROXIES that gave the client address in X-Forwarded-For,
+so that a client cannot make the API hand out URLs of another scheme.
+*/
+func requestBaseURL(c *gin.Context) string {
+	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); (proto == "http" || proto == "https") && c.ClientIP() != c.RemoteIP() {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// Keys of the values the handlers and the audit middleware share in the context.
+const (
+	requestIDKey = "request_id"
+	actorKey     = "actor"
+)
+
+/*
+Return who made the request, as authenticated by RequireStaff or by a handler that authenticates the user.
+It is empty for a request nobody authenticated, since a header the client sends could name anyone.
+*/
+func requestActor(c *gin.Context) string {
+	return c.GetString(actorKey)
+}
+
+// Return who made the request, from which address, and in which request, for the audit log.
+func requestAudit(c *gin.Context) accessdb.Audit {
+	return accessdb.Audit{RequestID: c.GetString(requestIDKey), Actor: requestActor(c), IP: c.ClientIP()}
+}
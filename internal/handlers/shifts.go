@@ -6,19 +6,35 @@ import (
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
 )
 
 type ExchangeData struct {
-	Login1 string `json:"login1"`
-	Login2 string `json:"login2"`
-	Date1  string `json:"date1"`
-	Date2  string `json:"date2"`
+	Login1   string `json:"login1"`
+	Login2   string `json:"login2"`
+	Date1    string `json:"date1"`
+	Date2    string `json:"date2"`
+	SlotID1  *uint  `json:"slot_id1"`
+	SlotID2  *uint  `json:"slot_id2"`
+	ShiftID1 uint   `json:"shift_id1"`
+	ShiftID2 uint   `json:"shift_id2"`
 }
 
 type DeleteData struct {
-	Login string `json:"login"`
-	Date  string `json:"date"`
+	Login   string `json:"login"`
+	Date    string `json:"date"`
+	SlotID  *uint  `json:"slot_id"`
+	ShiftID uint   `json:"shift_id"`
+	Reason  string `json:"reason"`
+}
+
+type DeleteRangeData struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Login    string `json:"login"`
+	Location string `json:"location"`
+	Reason   string `json:"reason"`
 }
 
 // Handle the endpoint that gets the shift.
@@ -49,11 +65,21 @@ func AddShiftData(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Shift is required"})
 		return
 	}
-	if date, err := accessdb.AddShiftToDB(schedule); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	for _, s := range schedule {
+		if err := validateSlotTime(s.StartTime, s.EndTime); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if s.Capacity < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Capacity must not be negative"})
+			return
+		}
+	}
+	if status, date, err := accessdb.AddShiftToDB(schedule, requestAudit(c)); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	} else {
-		c.JSON(http.StatusOK, gin.H{"date": date})
+		c.JSON(status, gin.H{"date": date})
 	}
 }
 
@@ -73,6 +99,21 @@ func isDateStringValid(date string) bool {
 	return regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`).MatchString(date)
 }
 
+func isTimeStringValid(t string) bool {
+	return regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d$`).MatchString(t)
+}
+
+// Check that the start and end times of a slot are in HH:MM format and in order, if given.
+func validateSlotTime(startTime string, endTime string) error {
+	if (startTime != "" && !isTimeStringValid(startTime)) || (endTime != "" && !isTimeStringValid(endTime)) {
+		return errors.New("Invalid time format. It should be in HH:MM format")
+	}
+	if startTime != "" && endTime != "" && startTime >= endTime {
+		return errors.New("Invalid time range")
+	}
+	return nil
+}
+
 // Handle the endpoint that exchanges shifts.
 func ExchangeShiftData(c *gin.Context) {
 	var e ExchangeData
@@ -88,11 +129,11 @@ func ExchangeShiftData(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. It should be in YYYY-MM-DD format"})
 		return
 	}
-	if shift1, shift2, err := accessdb.ExchangeShiftsOnDB(e.Login1, e.Login2, e.Date1, e.Date2); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if status, shift1, shift2, err := accessdb.ExchangeShiftsOnDB(e.Login1, e.Login2, e.Date1, e.Date2, e.SlotID1, e.SlotID2, e.ShiftID1, e.ShiftID2, requestAudit(c)); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	} else {
-		c.JSON(http.StatusOK, gin.H{
+		c.JSON(status, gin.H{
 			"shifts": []*accessdb.Shift{shift1, shift2},
 		})
 	}
@@ -105,18 +146,103 @@ func DeleteShiftData(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if d.Login == "" || d.Date == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "login and date are required"})
+	if d.ShiftID == 0 && (d.Login == "" || d.Date == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "login and date, or shift_id are required"})
 		return
 	}
-	if !isDateStringValid(d.Date) {
+	if d.Date != "" && !isDateStringValid(d.Date) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. It should be in YYYY/MM/DD format"})
 		return
 	}
-	if shift, err := accessdb.DeleteShiftFromDB(d.Login, d.Date); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if status, shift, err := accessdb.DeleteShiftFromDB(d.Login, d.Date, d.SlotID, d.ShiftID, d.Reason, requestAudit(c)); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	} else {
-		c.JSON(http.StatusOK, shift)
+		c.JSON(status, shift)
+	}
+}
+
+// Handle the endpoint that deletes the shifts in a date range.
+func DeleteShiftRangeData(c *gin.Context) {
+	var d DeleteRangeData
+	if err := c.BindJSON(&d); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if d.Start == "" || d.End == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start and end are required"})
+		return
+	}
+	if !isDateStringValid(d.Start) || !isDateStringValid(d.End) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. It should be in YYYY-MM-DD format"})
+		return
+	}
+	if d.Start > d.End {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range"})
+		return
+	}
+	status, shifts, err := accessdb.DeleteShiftsInRangeFromDB(d.Start, d.End, d.Login, d.Location, d.Reason, requestAudit(c))
+	if err != nil {
+		if status == http.StatusNotFound {
+			c.JSON(status, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(status, gin.H{"error": "Failed to delete shifts"})
+		}
+		return
+	}
+	c.JSON(status, gin.H{"shifts": shifts})
+}
+
+// Handle the endpoint that gets the shifts deleted in a date range.
+func GetDeletedShiftData(c *gin.Context) {
+	start, end, err := getQueryAboutDateRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	shifts, err := accessdb.GetDeletedShiftsFromDB(start, end)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shifts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"shifts": shifts})
+}
+
+// Handle the endpoint that restores a deleted shift.
+func RestoreShiftData(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid shift id"})
+		return
+	}
+	status, shift, err := accessdb.RestoreShiftOnDB(uint(id), requestAudit(c))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, shift)
+}
+
+/*
+Determine the first and last dates from the start and end queries.
+If there is no start parameter, the first date will be the execution date.
+If there is no end parameter, the last date will be the same as the first date.
+*/
+func getQueryAboutDateRange(c *gin.Context) (string, string, error) {
+	start := c.Query("start")
+	if start == "" {
+		start = time.Now().Format("2006-01-02")
+	}
+	end := c.Query("end")
+	if end == "" {
+		end = start
+	}
+	if !isDateStringValid(start) || !isDateStringValid(end) {
+		return "", "", errors.New("Invalid date format. It should be in YYYY-MM-DD format")
+	}
+	if start > end {
+		return "", "", errors.New("Invalid date range")
 	}
+	return start, end, nil
 }
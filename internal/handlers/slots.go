@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/loadconfig"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type SlotRequestData struct {
+	Date      string `json:"date"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	Location  string `json:"location"`
+	Role      string `json:"role"`
+	Capacity  int    `json:"capacity"`
+}
+
+// Handle the endpoint that gets the open slots.
+func GetSlotData(c *gin.Context) {
+	date, err := getQueryAboutDate(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query"})
+		return
+	}
+
+	slots, err := accessdb.GetOpenSlotsFromDB(date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get slots"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"slots": slots})
+}
+
+// Handle the endpoint that publishes an open slot.
+func AddSlotData(c *gin.Context) {
+	var requestData SlotRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestData.Date == "" || requestData.Capacity <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date and capacity are required"})
+		return
+	}
+	if !isDateStringValid(requestData.Date) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. It should be in YYYY-MM-DD format"})
+		return
+	}
+	if err := validateSlotTime(requestData.StartTime, requestData.EndTime); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status, slot, err := accessdb.AddOpenSlotToDB(accessdb.Schedule{
+		Date:      requestData.Date,
+		StartTime: requestData.StartTime,
+		EndTime:   requestData.EndTime,
+		Location:  requestData.Location,
+		Role:      requestData.Role,
+		Capacity:  requestData.Capacity,
+	})
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, slot)
+}
+
+// Handle the endpoint where a student claims an open slot.
+func ClaimSlot(c *gin.Context) {
+	handleSlotSignUp(c, accessdb.ClaimSlotOnDB)
+}
+
+// Handle the endpoint where a student releases a claimed slot.
+func ReleaseSlot(c *gin.Context) {
+	handleSlotSignUp(c, accessdb.ReleaseSlotOnDB)
+}
+
+func handleSlotSignUp(c *gin.Context, signUp func(uint, string, time.Duration, accessdb.Audit) (int, *accessdb.Shift, error)) {
+	slotId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot id"})
+		return
+	}
+	login, err := authenticatedLogin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	cutoff := time.Duration(loadconfig.GetEnvInt("SLOT_CUTOFF_MINUTES", 60)) * time.Minute
+	status, shift, err := signUp(uint(slotId), login, cutoff, requestAudit(c))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, shift)
+}
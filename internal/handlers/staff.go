@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/loadconfig"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+/*
+Middleware that lets only the staff in STAFF_LOGINS through, authenticated by their 42 intra access token,
+and sets the login as the actor of the request. The endpoints are closed while STAFF_LOGINS is not set.
+*/
+func RequireStaff() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		staff := staffLogins()
+		if len(staff) == 0 {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Staff logins are not configured"})
+			return
+		}
+		login, err := authenticatedLogin(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Failed to authenticate"})
+			return
+		}
+		if !staff[login] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Staff only"})
+			return
+		}
+		c.Set(actorKey, login)
+		c.Next()
+	}
+}
+
+// Return the logins in STAFF_LOGINS, separated by commas.
+func staffLogins() map[string]bool {
+	staff := make(map[string]bool)
+	for _, login := range strings.Split(loadconfig.GetEnv("STAFF_LOGINS", ""), ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			staff[login] = true
+		}
+	}
+	return staff
+}
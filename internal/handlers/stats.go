@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// The longest time range the activity statistics are counted over, in seconds.
+const maxStatsRange = 5 * 366 * 24 * 60 * 60
+
+/*
+Handles the endpoint that gets the number of taps and unique users of the activities in a time range,
+grouped by the group_by query and optionally narrowed to a role, location, or login.
+The range can be at most five years long.
+*/
+func GetActivityStats(c *gin.Context) {
+	start_time, end_time, err := GetQueryAboutTime(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query"})
+		return
+	}
+	if end_time-start_time > maxStatsRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The time range must be at most five years long"})
+		return
+	}
+	groupBy := c.DefaultQuery("group_by", "day")
+
+	status, stats, err := accessdb.GetActivityStatsFromDB(start_time, end_time, groupBy, c.Query("role"), c.Query("location"), c.Query("login"))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	var total int64
+	for _, s := range stats {
+		total += s.Count
+	}
+	c.JSON(status, gin.H{"group_by": groupBy, "start": start_time, "end": end_time, "total": total, "stats": stats})
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/events"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How often a comment is sent to keep an idle stream open through proxies.
+const streamKeepAlive = 15 * time.Second
+
+/*
+Handles the endpoint that streams new activities as Server-Sent Events, optionally narrowed to a role and location.
+A client that reconnects with the Last-Event-ID header gets the activities it missed first,
+as long as they are still kept by the event bus.
+*/
+func StreamActivities(c *gin.Context) {
+	role := c.Query("role")
+	location := c.Query("location")
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_event_id")
+	}
+	var lastEventID int64
+	if lastID != "" {
+		var err error
+		if lastEventID, err = strconv.ParseInt(lastID, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	subscription, missed := events.Default.Subscribe(lastEventID)
+	defer subscription.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// The stream outlives the write timeout of the server, and ends when the client goes away or the API shuts down.
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	matches := func(e events.Event) bool {
+		var activity accessdb.ActivityEvent
+		if e.Type != "activity.created" || decodeEventData(e, &activity) != nil {
+			return false
+		}
+		return (role == "" || activity.Role == role) && (location == "" || activity.Location == location)
+	}
+	for _, e := range missed {
+		if matches(e) {
+			writeEvent(c, e)
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case e, ok := <-subscription.C:
+			if !ok {
+				// The client fell behind, so let it reconnect and resume from the last event.
+				return
+			}
+			if matches(e) {
+				writeEvent(c, e)
+				c.Writer.Flush()
+			}
+		case <-ticker.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+// Decodes the data of the event, which is the JSON of the outbox when the event was relayed from it.
+func decodeEventData(e events.Event, v interface{}) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeEvent(c *gin.Context, e events.Event) {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/wallet"
 	"github.com/gin-gonic/gin"
 	"net/http"
 )
@@ -18,7 +19,7 @@ func AddUsers(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User is not specified"})
 		return
 	}
-	if addedLogin, err := accessdb.AddUsersToDB(requestData.Users); err != nil {
+	if addedLogin, err := accessdb.AddUsersToDB(requestData.Users, requestAudit(c)); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "users": addedLogin})
 		return
 	} else {
@@ -39,7 +40,15 @@ func EditUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Login is required"})
 		return
 	}
-	if err := accessdb.EditUserInDB(requestData.Uid, requestData.Login, requestData.Wallet); err != nil {
+	if requestData.Wallet != "" {
+		address, err := wallet.NormalizeAddress(requestData.Wallet)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		requestData.Wallet = address
+	}
+	if err := accessdb.EditUserInDB(requestData.Uid, requestData.Login, requestData.Wallet, requestAudit(c)); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// How long a wallet challenge can be signed.
+const walletChallengeTTL = 10 * time.Minute
+
+type WalletChallengeRequestData struct {
+	Wallet string `json:"wallet"`
+}
+
+type WalletVerifyRequestData struct {
+	Signature string `json:"signature"`
+}
+
+// Handle the endpoint that issues a message for the authenticated user to sign with the wallet.
+func AddWalletChallenge(c *gin.Context) {
+	var requestData WalletChallengeRequestData
+
+	login, err := authenticatedLogin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	challenge, err := accessdb.AddWalletChallengeToDB(login, requestData.Wallet, walletChallengeTTL)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"wallet":     challenge.Wallet,
+		"nonce":      challenge.Nonce,
+		"message":    challenge.Message(login),
+		"expires_at": challenge.ExpiresAt,
+	})
+}
+
+// Handle the endpoint that verifies the signed challenge and sets the wallet of the authenticated user.
+func VerifyWallet(c *gin.Context) {
+	var requestData WalletVerifyRequestData
+
+	login, err := authenticatedLogin(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestData.Signature == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Signature is required"})
+		return
+	}
+	status, user, err := accessdb.VerifyWalletOnDB(login, requestData.Signature, requestAudit(c))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, gin.H{"login": user.Login, "wallet": user.Wallet, "wallet_verified": user.WalletVerified})
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/events"
+	"42ActivityAPI/internal/loadconfig"
+	"42ActivityAPI/internal/outbox"
+	"42ActivityAPI/internal/webhook"
+	"context"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+type WebhookRequestData struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+/*
+Handles the endpoint that adds a webhook subscribing to event types, or "*" for every event.
+The secret is generated if it is not given, and is returned only in this response.
+*/
+func AddWebhook(c *gin.Context) {
+	var requestData WebhookRequestData
+
+	if err := c.BindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := webhook.CheckURL(c.Request.Context(), requestData.URL, webhookAllowPrivate()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(requestData.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Events are required"})
+		return
+	}
+	for _, e := range requestData.Events {
+		if e != "*" && !slices.Contains(webhook.EventTypes, e) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event type: " + e})
+			return
+		}
+	}
+	hook, err := accessdb.AddWebhookToDB(requestData.URL, requestData.Events, requestData.Secret, requestActor(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add webhook"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": hook, "secret": hook.Secret})
+}
+
+// Handles the endpoint that gets the webhooks.
+func GetWebhooks(c *gin.Context) {
+	webhooks, err := accessdb.GetWebhooksFromDB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhooks"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+// Handles the endpoint that deletes a webhook.
+func DeleteWebhook(c *gin.Context) {
+	id, ok := webhookParamID(c, "Invalid webhook id")
+	if !ok {
+		return
+	}
+	if err := accessdb.DeleteWebhookFromDB(id); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+// Handles the endpoint that gets the delivery log of a webhook, narrowed by the status query.
+func GetWebhookDeliveries(c *gin.Context) {
+	id, ok := webhookParamID(c, "Invalid webhook id")
+	if !ok {
+		return
+	}
+	status := c.Query("status")
+	if status != "" && status != "pending" && status != "succeeded" && status != "failed" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be one of pending, succeeded, and failed"})
+		return
+	}
+	limit, err := getQueryInt(c, "limit", 100)
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	deliveries, err := accessdb.GetWebhookDeliveriesFromDB(id, status, limit)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhook deliveries"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// Handles the endpoint that queues a delivery again, for example after the receiver was fixed.
+func RedeliverWebhookDelivery(c *gin.Context) {
+	id, ok := webhookParamID(c, "Invalid delivery id")
+	if !ok {
+		return
+	}
+	delivery, err := accessdb.RedeliverWebhookDeliveryOnDB(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delivery or its webhook not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeliver"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+/*
+Relays the events in the outbox to the event bus and the webhooks, and delivers the webhooks, until the context is done.
+The outbox and the due deliveries are checked at their intervals, and right after events are committed or queued.
+Returns once both have stopped.
+*/
+func RunEventRelay(ctx context.Context, outboxInterval time.Duration, webhookInterval time.Duration) {
+	timeout := time.Duration(loadconfig.GetEnvInt("WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second
+	dispatcher := webhook.NewDispatcher(timeout, loadconfig.GetEnvInt("WEBHOOK_MAX_ATTEMPTS", 8), webhookAllowPrivate())
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		dispatcher.Run(ctx, webhookInterval)
+	}()
+
+	retention := time.Duration(loadconfig.GetEnvInt("OUTBOX_RETENTION_DAYS", 7)) * 24 * time.Hour
+	outbox.NewRelay(events.Default, dispatcher, retention).Run(ctx, outboxInterval)
+	<-dispatched
+}
+
+// Returns whether webhooks may point to private addresses, for example while developing the receiver locally.
+func webhookAllowPrivate() bool {
+	return loadconfig.GetEnv("WEBHOOK_ALLOW_PRIVATE_URLS", "false") == "true"
+}
+
+func webhookParamID(c *gin.Context, message string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return 0, false
+	}
+	return uint(id), true
+}
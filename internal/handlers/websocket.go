@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"42ActivityAPI/internal/events"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How often the server pings the client, and how long it waits for any message from it.
+	websocketPingInterval = 30 * time.Second
+	websocketReadTimeout  = 60 * time.Second
+	websocketWriteTimeout = 10 * time.Second
+)
+
+// The subprotocol a browser offers alongside the dashboard token, which cannot send an Authorization header.
+const dashboardSubprotocol = "dashboard"
+
+// The dashboard authenticates with a token instead of cookies, so any origin may connect.
+var upgrader = websocket.Upgrader{
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{dashboardSubprotocol},
+}
+
+type WebSocketRequestData struct {
+	Action string   `json:"action"`
+	Topics []string `json:"topics"`
+}
+
+type WebSocketMessage struct {
+	ID     int64       `json:"id,omitempty"`
+	Type   string      `json:"type"`
+	Topics []string    `json:"topics,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+/*
+Handles the WebSocket endpoint of the live dashboards.
+The client authenticates with DASHBOARD_TOKEN as the Bearer token, or offers the subprotocols "dashboard" and the token,
+subscribes to the topics query,
+and can send {"action": "subscribe" or "unsubscribe", "topics": [...]} later.
+A topic is an event type, such as "shift.exchanged", the part before the dot, such as "shift", or "*" for every event.
+*/
+func DashboardWebSocket(c *gin.Context) {
+	if !authorizeDashboard(c) {
+		return
+	}
+	var lastEventID int64
+	if lastID := c.Query("last_event_id"); lastID != "" {
+		var err error
+		if lastEventID, err = strconv.ParseInt(lastID, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last_event_id"})
+			return
+		}
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	topics := make(map[string]bool)
+	for _, t := range strings.Split(c.Query("topics"), ",") {
+		if t != "" {
+			topics[t] = true
+		}
+	}
+	subscription, missed := events.Default.Subscribe(lastEventID)
+	defer subscription.Close()
+
+	requests := make(chan WebSocketRequestData)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go readWebSocket(conn, requests, done, quit)
+
+	write := func(message WebSocketMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		return conn.WriteJSON(message)
+	}
+	if err := write(WebSocketMessage{Type: "subscribed", Topics: topicList(topics)}); err != nil {
+		return
+	}
+	for _, e := range missed {
+		if matchesTopics(topics, e.Type) {
+			if err := write(WebSocketMessage{ID: e.ID, Type: e.Type, Data: e.Data}); err != nil {
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(websocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case request := <-requests:
+			for _, t := range request.Topics {
+				topics[t] = request.Action == "subscribe"
+			}
+			if err := write(WebSocketMessage{Type: "subscribed", Topics: topicList(topics)}); err != nil {
+				return
+			}
+		case e, ok := <-subscription.C:
+			if !ok {
+				// The client fell behind, so let it reconnect and resume from the last event.
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Too slow"), time.Now().Add(websocketWriteTimeout))
+				return
+			}
+			if matchesTopics(topics, e.Type) {
+				if err := write(WebSocketMessage{ID: e.ID, Type: e.Type, Data: e.Data}); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Reads the requests of the client until the connection is closed or goes quiet, or the handler quits.
+func readWebSocket(conn *websocket.Conn, requests chan<- WebSocketRequestData, done chan<- struct{}, quit <-chan struct{}) {
+	defer close(done)
+	conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+	})
+	for {
+		var request WebSocketRequestData
+		if err := conn.ReadJSON(&request); err != nil {
+			var syntaxError *json.SyntaxError
+			var typeError *json.UnmarshalTypeError
+			if errors.As(err, &syntaxError) || errors.As(err, &typeError) {
+				continue
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+		if request.Action != "subscribe" && request.Action != "unsubscribe" {
+			continue
+		}
+		select {
+		case requests <- request:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func matchesTopics(topics map[string]bool, eventType string) bool {
+	if topics["*"] || topics[eventType] {
+		return true
+	}
+	group, _, _ := strings.Cut(eventType, ".")
+	return topics[group]
+}
+
+func topicList(topics map[string]bool) []string {
+	list := []string{}
+	for t, subscribed := range topics {
+		if subscribed {
+			list = append(list, t)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+/*
+Checks the dashboard token of the request, and responds with an error if it is wrong.
+The token is never taken from the query, as the URL ends up in the access logs.
+The endpoints are closed while DASHBOARD_TOKEN is not set.
+*/
+func authorizeDashboard(c *gin.Context) bool {
+	expected := os.Getenv("DASHBOARD_TOKEN")
+	if expected == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Dashboard token is not configured"})
+		return false
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		for _, protocol := range websocket.Subprotocols(c.Request) {
+			if protocol != dashboardSubprotocol {
+				token = protocol
+				break
+			}
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid dashboard token"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package leaderboard
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"context"
+	"errors"
+	"github.com/jinzhu/now"
+	"log"
+	"sync"
+	"time"
+)
+
+// Leaderboards nobody asked for in this long are dropped instead of refreshed.
+const idleTimeout = 24 * time.Hour
+
+type Key struct {
+	Role   string
+	Period string
+	Metric string
+}
+
+type Board struct {
+	Role      string                      `json:"role"`
+	Period    string                      `json:"period"`
+	Metric    string                      `json:"metric"`
+	Start     int64                       `json:"start"`
+	End       int64                       `json:"end"`
+	UpdatedAt int64                       `json:"updated_at"`
+	Entries   []accessdb.LeaderboardEntry `json:"entries"`
+}
+
+// Receives the key and the time range of its period, and returns the ranking computed from the DB.
+type ComputeFunc func(key Key, start int64, end int64) ([]accessdb.LeaderboardEntry, error)
+
+type cached struct {
+	board       *Board
+	requestedAt time.Time
+}
+
+/*
+Keeps the leaderboards that were asked for, so that a request returns the last computed one
+instead of ranking every activity again. Run refreshes them in the background.
+*/
+type Cache struct {
+	mu     sync.Mutex
+	boards map[Key]*cached
+	// Incremented by Invalidate, so that a board computed before it is not stored.
+	generation uint64
+	compute    ComputeFunc
+}
+
+func NewCache(compute ComputeFunc) *Cache {
+	return &Cache{boards: make(map[Key]*cached), compute: compute}
+}
+
+// Returns the cached leaderboard of the key, computing it if it has not been asked for yet.
+func (c *Cache) Get(key Key) (*Board, error) {
+	c.mu.Lock()
+	if entry, ok := c.boards[key]; ok {
+		entry.requestedAt = time.Now()
+		board := entry.board
+		c.mu.Unlock()
+		return board, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	board, err := c.build(key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		c.boards[key] = &cached{board: board, requestedAt: time.Now()}
+	}
+	c.mu.Unlock()
+	return board, nil
+}
+
+// Drops every cached leaderboard, for example after a user opted out.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	c.boards = make(map[Key]*cached)
+	c.generation++
+	c.mu.Unlock()
+}
+
+// Refreshes the cached leaderboards at the interval until the context is done.
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			c.refresh(t)
+		}
+	}
+}
+
+func (c *Cache) refresh(t time.Time) {
+	c.mu.Lock()
+	generation := c.generation
+	var keys []Key
+	for key, entry := range c.boards {
+		if t.Sub(entry.requestedAt) > idleTimeout {
+			delete(c.boards, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+
+	for _, key := range keys {
+		board, err := c.build(key, t)
+		if err != nil {
+			log.Println("Failed to refresh leaderboard: ", err)
+			continue
+		}
+		c.mu.Lock()
+		if entry, ok := c.boards[key]; ok && c.generation == generation {
+			entry.board = board
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *Cache) build(key Key, t time.Time) (*Board, error) {
+	start, end, err := PeriodRange(key.Period, t)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.compute(key, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &Board{Role: key.Role, Period: key.Period, Metric: key.Metric, Start: start, End: end, UpdatedAt: t.Unix(), Entries: entries}, nil
+}
+
+/*
+Receives the period and the current time, and returns the time range of the period so far.
+The period is day, week (from Monday), month, or all.
+*/
+func PeriodRange(period string, t time.Time) (int64, int64, error) {
+	n := (&now.Config{WeekStartDay: time.Monday}).With(t)
+	switch period {
+	case "day":
+		return n.BeginningOfDay().Unix(), t.Unix() + 1, nil
+	case "week":
+		return n.BeginningOfWeek().Unix(), t.Unix() + 1, nil
+	case "month":
+		return n.BeginningOfMonth().Unix(), t.Unix() + 1, nil
+	case "all":
+		return 0, t.Unix() + 1, nil
+	}
+	return 0, 0, errors.New("period must be one of day, week, month, and all")
+}
@@ -3,6 +3,7 @@ package loadconfig
 import (
 	"errors"
 	"os"
+	"strconv"
 )
 
 type Config struct {
@@ -23,3 +24,20 @@ func LoadConfig() (*Config, error) {
 	}
 	return config, nil
 }
+
+// Loading an optional environment variable, falling back to the default if it is not set.
+func GetEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Loading an optional integer environment variable, falling back to the default if it is not set or invalid.
+func GetEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
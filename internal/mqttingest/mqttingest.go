@@ -0,0 +1,223 @@
+package mqttingest
+
+import (
+	"encoding/json"
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a recorded tap is remembered to drop its redeliveries.
+	dedupWindow = time.Hour
+	// The first and the longest wait between attempts to record a tap that failed on the server side.
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = time.Minute
+)
+
+/*
+Receives the MAC address, uid and token of a tap, checks the token of the M5stick like the HTTP endpoint,
+records the tap, and returns an HTTP status code like AddActivityToDB.
+*/
+type TapHandler func(mac string, uid string, token string) (int, error)
+
+type Config struct {
+	Broker      string
+	ClientID    string
+	Username    string
+	Password    string
+	TopicPrefix string
+	// The wait before the first retry of a tap that failed on the server side, doubled after each retry.
+	RetryBackoff time.Duration
+}
+
+type TapMessage struct {
+	Uid   string `json:"uid"`
+	Token string `json:"token"`
+	// Unix time at which the card was tapped on the M5stick, so that a tap sent again is recognized.
+	Timestamp int64 `json:"timestamp"`
+}
+
+type Subscriber struct {
+	client mqtt.Client
+	topic  string
+	done   chan struct{}
+}
+
+/*
+Connect to the broker and subscribe to the taps of every M5stick at "<prefix>/<mac>/taps" with QoS 1.
+The session is kept by the broker, so messages that were not acknowledged are delivered again on reconnect.
+*/
+func Start(config Config, handle TapHandler) (*Subscriber, error) {
+	topic := config.TopicPrefix + "/+/taps"
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetAutoAckDisabled(true)
+
+	// Subscribe again whenever the connection is (re)established.
+	recorded := &recentTaps{taps: map[string]time.Time{}}
+	backoff := config.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	done := make(chan struct{})
+	subscribed := make(chan error, 1)
+	options.SetOnConnectHandler(func(client mqtt.Client) {
+		token := client.Subscribe(topic, 1, func(_ mqtt.Client, message mqtt.Message) {
+			handleMessage(config.TopicPrefix, message, handle, recorded, backoff, done)
+		})
+		token.WaitTimeout(10 * time.Second)
+		if token.Error() != nil {
+			log.Println("Error: Failed to subscribe to MQTT topic: ", token.Error())
+		}
+		select {
+		case subscribed <- token.Error():
+		default:
+		}
+	})
+
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return nil, errors.New("Timed out connecting to MQTT broker")
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	select {
+	case err := <-subscribed:
+		if err != nil {
+			client.Disconnect(0)
+			return nil, err
+		}
+	case <-time.After(10 * time.Second):
+		client.Disconnect(0)
+		return nil, errors.New("Timed out subscribing to MQTT topic")
+	}
+	return &Subscriber{client: client, topic: topic, done: done}, nil
+}
+
+// Stop retrying the taps that failed, unsubscribe and disconnect from the broker.
+func (s *Subscriber) Close() {
+	close(s.done)
+	s.client.Unsubscribe(s.topic).WaitTimeout(time.Second)
+	s.client.Disconnect(250)
+}
+
+/*
+Record the tap in the message and acknowledge it.
+A tap that failed on the server side is retried with backoff until it is recorded, and only then acknowledged,
+so that an outage of the DB does not leave it waiting for a reconnect in the inflight window of the broker.
+If the subscriber is closed first, it is left unacknowledged for the broker to deliver it again on reconnect.
+A tap that was already handled, or is being retried, is acknowledged without being recorded again,
+so that a redelivery does not flip the session.
+*/
+func handleMessage(prefix string, message mqtt.Message, handle TapHandler, recorded *recentTaps, backoff time.Duration, done <-chan struct{}) {
+	mac, ok := macFromTopic(prefix, message.Topic())
+	if !ok {
+		log.Println("Error: Unexpected MQTT topic: ", message.Topic())
+		message.Ack()
+		return
+	}
+	var tap TapMessage
+	if err := json.Unmarshal(message.Payload(), &tap); err != nil || tap.Uid == "" {
+		log.Println("Error: Invalid MQTT tap message from ", mac)
+		message.Ack()
+		return
+	}
+	key := tapKey(mac, tap, message)
+	if tap.Timestamp == 0 && !message.Duplicate() {
+		// The broker reuses the ID of a message once it is acknowledged.
+		recorded.forget(key)
+	}
+	if !recorded.claim(key) {
+		message.Ack()
+		return
+	}
+	for {
+		status, err := handle(mac, tap.Uid, tap.Token)
+		if err == nil {
+			break
+		}
+		if status < http.StatusInternalServerError {
+			log.Printf("Error: Rejected MQTT tap from %s: %v\n", mac, err)
+			break
+		}
+		log.Printf("Error: Failed to record MQTT tap of %s from %s, retrying in %v: %v\n", tap.Uid, mac, backoff, err)
+		select {
+		case <-done:
+			recorded.forget(key)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+	message.Ack()
+}
+
+/*
+Return the key that identifies a tap across deliveries: the MAC address, uid and timestamp of the tap.
+A tap without a timestamp is identified by its MQTT message ID, which is kept by the broker when it redelivers the message.
+*/
+func tapKey(mac string, tap TapMessage, message mqtt.Message) string {
+	if tap.Timestamp != 0 {
+		return mac + "|" + tap.Uid + "|" + strconv.FormatInt(tap.Timestamp, 10)
+	}
+	return "message|" + strconv.Itoa(int(message.MessageID()))
+}
+
+// The keys of the taps handled within the dedup window.
+type recentTaps struct {
+	mu   sync.Mutex
+	taps map[string]time.Time
+}
+
+/*
+Receives the key of a tap, and remembers it unless it was handled within the dedup window.
+Returns whether the tap is to be handled now, and forgets the keys older than the dedup window.
+*/
+func (r *recentTaps) claim(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for k, handled := range r.taps {
+		if now.Sub(handled) > dedupWindow {
+			delete(r.taps, k)
+		}
+	}
+	if _, ok := r.taps[key]; ok {
+		return false
+	}
+	r.taps[key] = now
+	return true
+}
+
+func (r *recentTaps) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.taps, key)
+}
+
+// Return the MAC address in a topic of the form "<prefix>/<mac>/taps".
+func macFromTopic(prefix string, topic string) (string, bool) {
+	rest, ok := strings.CutPrefix(topic, prefix+"/")
+	if !ok {
+		return "", false
+	}
+	mac, ok := strings.CutSuffix(rest, "/taps")
+	if !ok || mac == "" || strings.Contains(mac, "/") {
+		return "", false
+	}
+	return mac, true
+}
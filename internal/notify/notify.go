@@ -0,0 +1,194 @@
+package notify
+
+import (
+	"42ActivityAPI/internal/loadconfig"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// A notification to a student.
+type Message struct {
+	Login   string
+	Subject string
+	Body    string
+}
+
+// A channel notifications are sent through. Name identifies the channel in the logs of what was sent.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, message Message) error
+}
+
+// Writes the notifications to the log, for development and as a record.
+type LogNotifier struct{}
+
+func (LogNotifier) Name() string {
+	return "log"
+}
+
+func (LogNotifier) Notify(ctx context.Context, message Message) error {
+	log.Printf("Notification to %s: %s: %s\n", message.Login, message.Subject, message.Body)
+	return nil
+}
+
+// The longest a mail may take to send, from connecting to the SMTP server to quitting.
+const smtpTimeout = 30 * time.Second
+
+// Sends the notifications by email to the login at the domain.
+type SMTPNotifier struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+	Domain   string
+}
+
+func (SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+func (n SMTPNotifier) Notify(ctx context.Context, message Message) error {
+	to := message.Login + "@" + n.Domain
+	var mail bytes.Buffer
+	fmt.Fprintf(&mail, "From: %s\r\n", n.From)
+	fmt.Fprintf(&mail, "To: %s\r\n", to)
+	fmt.Fprintf(&mail, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&mail, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprint(&mail, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprint(&mail, strings.ReplaceAll(message.Body, "\n", "\r\n"), "\r\n")
+
+	return n.send(ctx, to, mail.Bytes())
+}
+
+/*
+Sends the mail like smtp.SendMail, upgrading to TLS and authenticating when the server supports it,
+but gives up at the timeout or when the context is done, so that a server that hangs does not hold up the caller.
+*/
+func (n SMTPNotifier) send(ctx context.Context, to string, mail []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	host, _, _ := strings.Cut(n.Addr, ":")
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := client.Mail(n.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(mail); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Posts the notifications to a Slack-compatible incoming webhook, mentioning the login.
+type SlackNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (SlackNotifier) Name() string {
+	return "slack"
+}
+
+func (n SlackNotifier) Notify(ctx context.Context, message Message) error {
+	body, err := json.Marshal(map[string]string{"text": fmt.Sprintf("@%s *%s*\n%s", message.Login, message.Subject, message.Body)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Slack webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+/*
+Returns the notifiers of the channels in NOTIFY_CHANNELS, a comma-separated list of log, smtp, and slack.
+Each channel has to be configured by its environment variables.
+*/
+func FromEnv() ([]Notifier, error) {
+	var notifiers []Notifier
+	for _, channel := range strings.Split(loadconfig.GetEnv("NOTIFY_CHANNELS", "log"), ",") {
+		switch strings.TrimSpace(channel) {
+		case "":
+		case "log":
+			notifiers = append(notifiers, LogNotifier{})
+		case "smtp":
+			n := SMTPNotifier{
+				Addr:     os.Getenv("SMTP_ADDR"),
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+				From:     os.Getenv("SMTP_FROM"),
+				Domain:   os.Getenv("NOTIFY_EMAIL_DOMAIN"),
+			}
+			if n.Addr == "" || n.From == "" || n.Domain == "" {
+				return nil, errors.New("SMTP_ADDR, SMTP_FROM, and NOTIFY_EMAIL_DOMAIN are required for smtp")
+			}
+			notifiers = append(notifiers, n)
+		case "slack":
+			n := SlackNotifier{URL: os.Getenv("SLACK_WEBHOOK_URL"), Client: &http.Client{Timeout: 10 * time.Second}}
+			if n.URL == "" {
+				return nil, errors.New("SLACK_WEBHOOK_URL is required for slack")
+			}
+			notifiers = append(notifiers, n)
+		default:
+			return nil, errors.New("Unknown notification channel: " + channel)
+		}
+	}
+	return notifiers, nil
+}
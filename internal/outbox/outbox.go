@@ -0,0 +1,152 @@
+package outbox
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/events"
+	"42ActivityAPI/internal/webhook"
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	// Events relayed in one pass, and how often dispatched events older than the retention are deleted.
+	batchSize     = 100
+	pruneInterval = time.Hour
+	/*
+		How long an ID skipped in the outbox is looked for again, as the transaction writing it may commit after a later one,
+		and the most IDs skipped at once that are looked for.
+	*/
+	missingWait = time.Minute
+	maxMissing  = 1000
+)
+
+/*
+Relays the events written to the outbox to the webhooks, and marks them as dispatched.
+An event is marked only after it is relayed, so it is relayed again if the API stops in between.
+The relays of the instances claim different events, so each event is queued for the webhooks once.
+
+Every instance also reads all the events of the outbox in the order of their IDs, and publishes them to its own event bus,
+so that the streams and dashboards connected to any instance get the events written by every instance.
+*/
+type Relay struct {
+	bus       *events.Bus
+	webhooks  *webhook.Dispatcher
+	retention time.Duration
+
+	// The ID of the last event published to the bus, and until when each skipped ID before it is looked for.
+	publishedID uint
+	started     bool
+	missing     map[uint]time.Time
+}
+
+func NewRelay(bus *events.Bus, webhooks *webhook.Dispatcher, retention time.Duration) *Relay {
+	return &Relay{bus: bus, webhooks: webhooks, retention: retention, missing: make(map[uint]time.Time)}
+}
+
+/*
+Relays the events as soon as they are committed, and at the interval in case a notification was missed, until the context is done.
+The events written by other instances are published to the bus at the interval.
+*/
+func (r *Relay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prunedAt time.Time
+	for {
+		r.relay()
+		r.Publish()
+		if time.Since(prunedAt) > pruneInterval {
+			r.prune()
+			prunedAt = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-accessdb.OutboxNotifications():
+		}
+	}
+}
+
+func (r *Relay) relay() {
+	for {
+		count, err := accessdb.RelayPendingOutboxEventsOnDB(batchSize, time.Now().Unix(), func(outboxEvents []accessdb.OutboxEvent) []uint {
+			var ids []uint
+			for _, o := range outboxEvents {
+				e := events.Event{ID: int64(o.ID), Type: o.Type, Data: json.RawMessage(o.Payload), CreatedAt: o.CreatedAt}
+				if err := r.webhooks.Queue(e); err != nil {
+					log.Println("Failed to queue webhook deliveries: ", err)
+					break
+				}
+				ids = append(ids, o.ID)
+			}
+			if len(ids) > 0 {
+				r.webhooks.Wake()
+			}
+			return ids
+		})
+		if err != nil {
+			log.Println("Failed to relay outbox events: ", err)
+			return
+		}
+		if count < batchSize {
+			return
+		}
+	}
+}
+
+/*
+Publishes the events written to the outbox since the last call to the bus. The first call only starts from the latest event.
+An ID skipped in between, whose transaction has not committed yet, is looked for again for a while,
+and its event is published once it is committed.
+*/
+func (r *Relay) Publish() {
+	if !r.started {
+		id, err := accessdb.GetLastOutboxEventIDFromDB()
+		if err != nil {
+			log.Println("Failed to get the last outbox event: ", err)
+			return
+		}
+		r.publishedID, r.started = id, true
+		return
+	}
+	now := time.Now()
+	for {
+		missingIDs := make([]uint, 0, len(r.missing))
+		for id, until := range r.missing {
+			if now.After(until) {
+				delete(r.missing, id)
+			} else {
+				missingIDs = append(missingIDs, id)
+			}
+		}
+		outboxEvents, err := accessdb.GetOutboxEventsAfterFromDB(r.publishedID, missingIDs, batchSize)
+		if err != nil {
+			log.Println("Failed to read outbox events: ", err)
+			return
+		}
+		for _, o := range outboxEvents {
+			if o.ID > r.publishedID {
+				if o.ID-r.publishedID-1 <= maxMissing {
+					for id := r.publishedID + 1; id < o.ID; id++ {
+						r.missing[id] = now.Add(missingWait)
+					}
+				}
+				r.publishedID = o.ID
+			} else {
+				delete(r.missing, o.ID)
+			}
+			r.bus.PublishEvent(events.Event{ID: int64(o.ID), Type: o.Type, Data: json.RawMessage(o.Payload), CreatedAt: o.CreatedAt})
+		}
+		if len(outboxEvents) < batchSize {
+			return
+		}
+	}
+}
+
+func (r *Relay) prune() {
+	if _, err := accessdb.DeleteDispatchedOutboxEventsFromDB(time.Now().Add(-r.retention).Unix()); err != nil {
+		log.Println("Failed to delete dispatched outbox events: ", err)
+	}
+}
@@ -0,0 +1,177 @@
+package reminder
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/notify"
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A reminder of a shift that is due, and the offset before the shift it is sent at.
+type Reminder struct {
+	Shift    accessdb.Shift
+	Offset   time.Duration
+	StartsAt time.Time
+}
+
+// Receives a comma-separated list of durations, such as "24h,1h", and returns them from the longest.
+func ParseOffsets(value string) ([]time.Duration, error) {
+	var offsets []time.Duration
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		offset, err := time.ParseDuration(v)
+		if err != nil || offset <= 0 {
+			return nil, errors.New("Invalid reminder offset: " + v)
+		}
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets, nil
+}
+
+/*
+Receives the shift and the time whole-day shifts start at, such as "09:00", and returns the time the shift starts.
+A shift in a slot starts at the start time of the slot.
+*/
+func StartsAt(shift accessdb.Shift, dayStart string) (time.Time, error) {
+	if shift.Slot != nil && shift.Slot.StartTime != "" {
+		return shift.Slot.StartsAt()
+	}
+	return accessdb.Slot{Date: shift.Date, StartTime: dayStart}.StartsAt()
+}
+
+/*
+Receives shifts, the offsets, the current time, and the time whole-day shifts start at, and returns the reminders due now.
+Only the reminder of the shortest offset passed is due, so a shift added shortly before it starts gets one reminder, not one per offset.
+Shifts that have started are left out.
+*/
+func Due(shifts []accessdb.Shift, offsets []time.Duration, now time.Time, dayStart string) []Reminder {
+	var reminders []Reminder
+	for _, shift := range shifts {
+		startsAt, err := StartsAt(shift, dayStart)
+		if err != nil || !startsAt.After(now) {
+			continue
+		}
+		remaining := startsAt.Sub(now)
+		var due time.Duration
+		for _, offset := range offsets {
+			if offset >= remaining && (due == 0 || offset < due) {
+				due = offset
+			}
+		}
+		if due > 0 {
+			reminders = append(reminders, Reminder{Shift: shift, Offset: due, StartsAt: startsAt})
+		}
+	}
+	return reminders
+}
+
+// Returns the message reminding the student of the shift.
+func (r Reminder) Message() notify.Message {
+	when := r.Shift.Date
+	var details []string
+	if r.Shift.Slot != nil {
+		if r.Shift.Slot.StartTime != "" {
+			when = r.StartsAt.Format("2006-01-02 15:04")
+		}
+		if r.Shift.Slot.Role != nil {
+			details = append(details, r.Shift.Slot.Role.Name)
+		}
+		if r.Shift.Slot.Location != nil {
+			details = append(details, r.Shift.Slot.Location.Name)
+		}
+	}
+	if len(details) > 0 {
+		when += " (" + strings.Join(details, ", ") + ")"
+	}
+	return notify.Message{
+		Login:   r.Shift.User.Login,
+		Subject: "Shift reminder",
+		Body:    "You have a shift on " + when + ".",
+	}
+}
+
+// Sends the reminders of the shifts through the notifiers, each at most once per user, offset, and channel.
+type Scheduler struct {
+	notifiers []notify.Notifier
+	offsets   []time.Duration
+	dayStart  string
+}
+
+func NewScheduler(notifiers []notify.Notifier, offsets []time.Duration, dayStart string) *Scheduler {
+	return &Scheduler{notifiers: notifiers, offsets: offsets, dayStart: dayStart}
+}
+
+// Sends the due reminders at the interval until the context is done.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	if len(s.notifiers) == 0 || len(s.offsets) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			s.send(ctx, t)
+		}
+	}
+}
+
+func (s *Scheduler) send(ctx context.Context, now time.Time) {
+	// The longest offset is first, and a day more covers the shifts starting late on the last date.
+	end := now.Add(s.offsets[0] + 24*time.Hour)
+	shifts, err := accessdb.GetShiftsInRangeFromDB(now.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		log.Println("Failed to get shifts: ", err)
+		return
+	}
+	reminders := Due(shifts, s.offsets, now, s.dayStart)
+	if len(reminders) == 0 {
+		return
+	}
+
+	var shiftIds []uint
+	for _, r := range reminders {
+		shiftIds = append(shiftIds, r.Shift.ID)
+	}
+	logs, err := accessdb.GetReminderLogsFromDB(shiftIds)
+	if err != nil {
+		log.Println("Failed to get reminder logs: ", err)
+		return
+	}
+	type sentKey struct {
+		shiftId uint
+		userId  int
+		offset  int64
+		channel string
+	}
+	sent := make(map[sentKey]bool)
+	for _, l := range logs {
+		sent[sentKey{l.ShiftID, l.UserID, l.OffsetSeconds, l.Channel}] = true
+	}
+
+	for _, r := range reminders {
+		offset := int64(r.Offset / time.Second)
+		for _, n := range s.notifiers {
+			if sent[sentKey{r.Shift.ID, r.Shift.UserID, offset, n.Name()}] {
+				continue
+			}
+			if err := n.Notify(ctx, r.Message()); err != nil {
+				log.Printf("Failed to send reminder to %s through %s: %v\n", r.Shift.User.Login, n.Name(), err)
+				continue
+			}
+			reminderLog := accessdb.ReminderLog{ShiftID: r.Shift.ID, UserID: r.Shift.UserID, OffsetSeconds: offset, Channel: n.Name(), SentAt: time.Now().Unix()}
+			if err := accessdb.AddReminderLogToDB(reminderLog); err != nil {
+				log.Println("Failed to record reminder: ", err)
+			}
+		}
+	}
+}
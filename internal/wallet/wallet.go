@@ -0,0 +1,87 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+	"strings"
+)
+
+/*
+Receives an Ethereum address, and returns it in the EIP-55 mixed-case checksum form.
+An address written in a single case carries no checksum and is accepted as is,
+but a mixed-case address must match its checksum.
+*/
+func NormalizeAddress(address string) (string, error) {
+	digits, ok := strings.CutPrefix(address, "0x")
+	if !ok || len(digits) != 40 {
+		return "", errors.New("Wallet must be 0x followed by 40 hexadecimal digits")
+	}
+	if _, err := hex.DecodeString(digits); err != nil {
+		return "", errors.New("Wallet must be 0x followed by 40 hexadecimal digits")
+	}
+	checksummed := checksumAddress(digits)
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && address != checksummed {
+		return "", errors.New("Wallet checksum is invalid")
+	}
+	return checksummed, nil
+}
+
+func checksumAddress(digits string) string {
+	lower := strings.ToLower(digits)
+	hash := keccak256([]byte(lower))
+	result := []byte(lower)
+	for i, c := range result {
+		nibble := hash[i/2] >> 4
+		if i%2 == 1 {
+			nibble = hash[i/2] & 0x0f
+		}
+		if c >= 'a' && nibble >= 8 {
+			result[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(result)
+}
+
+/*
+Receives a message and its signature made by personal_sign (EIP-191),
+and returns the checksummed address of the key that signed it.
+The signature is 65 bytes of r, s and v in hexadecimal, where v is 0, 1, 27 or 28.
+*/
+func RecoverAddress(message string, signature string) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return "", errors.New("Signature must be 65 bytes in hexadecimal")
+	}
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return "", errors.New("Signature recovery id is invalid")
+	}
+
+	// The compact format puts the recovery code first, offset by 27 for an uncompressed key.
+	compact := make([]byte, 65)
+	compact[0] = 27 + v
+	copy(compact[1:], sig[:64])
+	publicKey, _, err := ecdsa.RecoverCompact(compact, hashMessage(message))
+	if err != nil {
+		return "", err
+	}
+	hash := keccak256(publicKey.SerializeUncompressed()[1:])
+	return checksumAddress(hex.EncodeToString(hash[12:])), nil
+}
+
+// Returns the hash that personal_sign signs for the message.
+func hashMessage(message string) []byte {
+	return keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+}
+
+func keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,228 @@
+package webhook
+
+import (
+	"42ActivityAPI/internal/accessdb"
+	"42ActivityAPI/internal/events"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// Deliveries attempted in one pass, and the longest wait between attempts.
+	batchSize  = 50
+	maxBackoff = 6 * time.Hour
+)
+
+// The event types a webhook can subscribe to.
+var EventTypes = []string{"activity.created", "shift.created", "shift.exchanged", "shift.deleted", "shift.restored", "shift.missed", "user.card_registered", "device.offline", "device.online"}
+
+// The JSON body posted to the webhooks.
+type Payload struct {
+	ID        int64       `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt int64       `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+/*
+Receives the secret of a webhook, the timestamp, and the body, and returns the signature sent in X-Webhook-Signature.
+It is the hex HMAC-SHA256 of the timestamp and the body joined by a dot, so that a receiver can reject replayed requests.
+*/
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Receives the number of attempts made, and returns how long to wait before the next one.
+func Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	if attempts > 16 {
+		return maxBackoff
+	}
+	return min(30*time.Second<<(attempts-1), maxBackoff)
+}
+
+// Receives an IP address, and returns whether it is a public one that webhooks may be delivered to.
+func PublicIP(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+/*
+Receives the URL of a webhook, and checks that it is http or https and, unless private addresses are allowed,
+that its host resolves only to public addresses, so that webhooks cannot reach the internal network.
+*/
+func CheckURL(ctx context.Context, raw string, allowPrivate bool) error {
+	u, err := url.ParseRequestURI(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("Invalid URL")
+	}
+	if allowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return errors.New("Failed to resolve the host of the URL")
+	}
+	for _, addr := range addrs {
+		if !PublicIP(addr.IP) {
+			return errors.New("URL must not point to a private address")
+		}
+	}
+	return nil
+}
+
+/*
+Queues the events to the subscribing webhooks, and delivers them with retries.
+The deliveries are kept in the DB, so the pending ones survive a restart.
+*/
+type Dispatcher struct {
+	client      *http.Client
+	timeout     time.Duration
+	maxAttempts int
+	wake        chan struct{}
+}
+
+/*
+Unless private addresses are allowed, every connection is checked again when it is dialed,
+so that a host resolving to another address later, or a redirect, cannot reach the internal network either.
+*/
+func NewDispatcher(timeout time.Duration, maxAttempts int, allowPrivate bool) *Dispatcher {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !PublicIP(net.ParseIP(host)) {
+				return errors.New("Webhook must not connect to a private address")
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	client := &http.Client{Timeout: timeout, Transport: transport}
+	return &Dispatcher{client: client, timeout: timeout, maxAttempts: maxAttempts, wake: make(chan struct{}, 1)}
+}
+
+// Delivers the due deliveries, checking for them at the interval and when woken, until the context is done.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+		d.deliverDue(ctx)
+	}
+}
+
+/*
+Queues a delivery of the event to each webhook subscribing to it.
+Queueing an event again does nothing, so an event relayed twice is delivered once.
+*/
+func (d *Dispatcher) Queue(e events.Event) error {
+	body, err := json.Marshal(Payload{ID: e.ID, Type: e.Type, CreatedAt: e.CreatedAt, Data: e.Data})
+	if err != nil {
+		return err
+	}
+	_, err = accessdb.QueueWebhookDeliveriesOnDB(e.ID, e.Type, string(body))
+	return err
+}
+
+// Makes Run check for due deliveries now, for example after events were queued.
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Claims the due deliveries for as long as posting all of them may take, and attempts each of them.
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	now := time.Now()
+	deliveries, err := accessdb.ClaimDueWebhookDeliveriesOnDB(now.Unix(), now.Add(batchSize*d.timeout+time.Minute).Unix(), batchSize)
+	if err != nil {
+		log.Println("Failed to get webhook deliveries: ", err)
+		return
+	}
+	for i := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+		d.Attempt(&deliveries[i], time.Now())
+		if err := accessdb.RecordWebhookAttemptOnDB(&deliveries[i]); err != nil {
+			log.Println("Failed to record webhook delivery: ", err)
+		}
+	}
+}
+
+/*
+Posts the payload of the delivery to its webhook, and updates the delivery with the result.
+A response other than 2xx schedules another attempt after the backoff, until the attempts run out.
+*/
+func (d *Dispatcher) Attempt(delivery *accessdb.WebhookDelivery, now time.Time) {
+	delivery.Attempts++
+	code, err := d.post(delivery, now)
+	delivery.ResponseCode = code
+	if err == nil {
+		delivery.Status = "succeeded"
+		delivery.Error = ""
+		delivery.DeliveredAt = now.Unix()
+		return
+	}
+	delivery.Error = err.Error()
+	if delivery.Attempts >= d.maxAttempts {
+		delivery.Status = "failed"
+		return
+	}
+	delivery.NextAttemptAt = now.Add(Backoff(delivery.Attempts)).Unix()
+}
+
+func (d *Dispatcher) post(delivery *accessdb.WebhookDelivery, now time.Time) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "42ActivityAPI-Webhook")
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-Webhook-Signature", Sign(delivery.Webhook.Secret, now.Unix(), body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}